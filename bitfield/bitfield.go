@@ -13,10 +13,13 @@ func (bf Bitfield) HasPiece(index int) bool {
 	return bf[byteIndex]>>uint(7-offset)&1 != 0
 }
 
-// SetPiece sets a bit in the bitfield
+// SetPiece sets a bit in the bitfield, indexes out of range are ignored
 func (bf Bitfield) SetPiece(index int) {
 	byteIndex := index / 8
 	offset := index % 8
+	if byteIndex < 0 || byteIndex >= len(bf) {
+		return
+	}
 
 	bf[byteIndex] |= 1 << uint(7-offset)
 }
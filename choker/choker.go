@@ -0,0 +1,237 @@
+// Package choker shares our upload tit-for-tat (BEP 3). The peers uploading the most to us
+// are unchoked, and one more picked at random now and then lets new peers prove themselves
+package choker
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"torrent/connection"
+)
+
+// Interval is how often the unchoked peers are chosen again
+var Interval = 10 * time.Second
+
+// OptimisticInterval is how often the optimistic unchoke moves to another peer
+var OptimisticInterval = 30 * time.Second
+
+// NewPeerTime is how long a peer counts as new. New peers are three times as likely to get
+// the optimistic unchoke, they have nothing to upload to us yet
+var NewPeerTime = time.Minute
+
+// DefaultSlots is the number of peers unchoked for their rates
+const DefaultSlots = 4
+
+// DefaultOptimisticSlots is the number of peers unchoked at random
+const DefaultOptimisticSlots = 1
+
+// Peer is what the choker needs from a connection, *connection.Connection satisfies it
+type Peer interface {
+	State() connection.State
+	SendChoke() error
+	SendUnchoke() error
+}
+
+// Clock tells the time, tests swap it for a fake one
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+type peerStats struct {
+	added      time.Time
+	downloaded int64 // totals at the previous round
+	uploaded   int64
+	rate       float64 // bytes per second over the previous round
+}
+
+// Choker implements tit-for-tat: every Interval the Slots interested peers that gave us the
+// most (or took the most once we are seeding) are unchoked, plus OptimisticSlots peers picked
+// at random every OptimisticInterval so that new peers get a chance to prove themselves
+type Choker struct {
+	Slots           int
+	OptimisticSlots int
+	// Seeding tells if we are seeding, peers are then ranked by how fast we upload to them
+	Seeding func() bool
+
+	clock          Clock
+	mu             sync.Mutex
+	peers          map[Peer]*peerStats
+	regular        map[Peer]bool
+	optimistic     map[Peer]bool
+	lastRound      time.Time
+	lastOptimistic time.Time
+}
+
+// New creates a choker with the default slots. clock can be nil to use the real time
+func New(clock Clock) *Choker {
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &Choker{
+		Slots:           DefaultSlots,
+		OptimisticSlots: DefaultOptimisticSlots,
+		clock:           clock,
+		peers:           map[Peer]*peerStats{},
+		regular:         map[Peer]bool{},
+		optimistic:      map[Peer]bool{},
+		lastRound:       clock.Now(),
+	}
+}
+
+// Add starts choking decisions for a peer
+func (c *Choker) Add(p Peer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := p.State()
+	c.peers[p] = &peerStats{added: c.clock.Now(), downloaded: state.Downloaded, uploaded: state.Uploaded}
+}
+
+// Remove forgets a peer that disconnected
+func (c *Choker) Remove(p Peer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.peers, p)
+	delete(c.regular, p)
+	delete(c.optimistic, p)
+}
+
+// Interested is called when a peer becomes interested. It is unchoked right away if a regular
+// slot is free instead of waiting for the next round
+func (c *Choker) Interested(p Peer) error {
+	c.mu.Lock()
+	if _, ok := c.peers[p]; !ok || c.regular[p] || c.optimistic[p] || len(c.regular) >= c.Slots {
+		c.mu.Unlock()
+		return nil
+	}
+	c.regular[p] = true
+	c.mu.Unlock()
+
+	// A peer that stopped reading blocks the write, which must not hold up the other peers
+	return p.SendUnchoke()
+}
+
+// Run rechokes every Interval until stop is closed
+func (c *Choker) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.Rechoke()
+		}
+	}
+}
+
+// Rechoke updates the rates of the peers and chooses the peers to unchoke
+func (c *Choker) Rechoke() {
+	unchoke, choke := c.choose()
+	for _, p := range unchoke {
+		p.SendUnchoke()
+	}
+	for _, p := range choke {
+		p.SendChoke()
+	}
+}
+
+// chooses the peers to unchoke and returns the peers whose choke state has to change
+func (c *Choker) choose() (unchoke, choke []Peer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	elapsed := now.Sub(c.lastRound).Seconds()
+	c.lastRound = now
+	seeding := c.Seeding != nil && c.Seeding()
+
+	interested := []Peer{}
+	for p, stats := range c.peers {
+		state := p.State()
+		if elapsed > 0 {
+			transferred := state.Downloaded - stats.downloaded
+			if seeding {
+				transferred = state.Uploaded - stats.uploaded
+			}
+			stats.rate = float64(transferred) / elapsed
+		}
+		stats.downloaded = state.Downloaded
+		stats.uploaded = state.Uploaded
+		if state.PeerInterested {
+			interested = append(interested, p)
+		}
+	}
+
+	// The fastest interested peers get the regular slots
+	sort.Slice(interested, func(i, j int) bool {
+		return c.peers[interested[i]].rate > c.peers[interested[j]].rate
+	})
+	regular := map[Peer]bool{}
+	for _, p := range interested {
+		if len(regular) >= c.Slots {
+			break
+		}
+		regular[p] = true
+	}
+
+	// The optimistic unchokes stay for OptimisticInterval unless they earned a regular slot
+	optimistic := map[Peer]bool{}
+	if now.Sub(c.lastOptimistic) < OptimisticInterval {
+		for p := range c.optimistic {
+			if !regular[p] && c.peers[p] != nil && p.State().PeerInterested {
+				optimistic[p] = true
+			}
+		}
+	} else {
+		c.lastOptimistic = now
+	}
+	for len(optimistic) < c.OptimisticSlots {
+		p := c.pickOptimistic(interested, regular, optimistic, now)
+		if p == nil {
+			break
+		}
+		optimistic[p] = true
+	}
+
+	c.regular = regular
+	c.optimistic = optimistic
+	for p := range c.peers {
+		unchoked := regular[p] || optimistic[p]
+		choking := p.State().AmChoking
+		if unchoked && choking {
+			unchoke = append(unchoke, p)
+		} else if !unchoked && !choking {
+			choke = append(choke, p)
+		}
+	}
+	return unchoke, choke
+}
+
+// picks a random interested peer left out of the other slots, new peers weigh three times more
+func (c *Choker) pickOptimistic(interested []Peer, regular, optimistic map[Peer]bool, now time.Time) Peer {
+	candidates := []Peer{}
+	for _, p := range interested {
+		if regular[p] || optimistic[p] {
+			continue
+		}
+		weight := 1
+		if now.Sub(c.peers[p].added) < NewPeerTime {
+			weight = 3
+		}
+		for i := 0; i < weight; i++ {
+			candidates = append(candidates, p)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
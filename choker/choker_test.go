@@ -0,0 +1,156 @@
+package choker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"torrent/connection"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// fakePeer starts choked and keeps track of the messages the choker sends it
+type fakePeer struct {
+	mu    sync.Mutex
+	state connection.State
+}
+
+func newFakePeer(interested bool) *fakePeer {
+	return &fakePeer{state: connection.State{AmChoking: true, PeerInterested: interested}}
+}
+
+func (p *fakePeer) State() connection.State {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+func (p *fakePeer) SendChoke() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state.AmChoking = true
+	return nil
+}
+
+func (p *fakePeer) SendUnchoke() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state.AmChoking = false
+	return nil
+}
+
+func (p *fakePeer) download(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state.Downloaded += n
+}
+
+func (p *fakePeer) choked() bool {
+	return p.State().AmChoking
+}
+
+func TestRechokeUnchokesFastest(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	c := New(clock)
+	c.OptimisticSlots = 0
+
+	// The peers give us 0, 100, 200... bytes per round, the fastest one is not interested
+	peers := []*fakePeer{}
+	for i := 0; i < 7; i++ {
+		p := newFakePeer(i != 6)
+		peers = append(peers, p)
+		c.Add(p)
+	}
+	for round := 0; round < 2; round++ {
+		for i, p := range peers {
+			p.download(int64(i) * 100)
+		}
+		clock.advance(Interval)
+		c.Rechoke()
+	}
+
+	for i, p := range peers {
+		want := i < 2 || i == 6
+		if p.choked() != want {
+			t.Errorf("peer %d: choked %t, want %t", i, p.choked(), want)
+		}
+	}
+
+	// The slowest peer speeding up takes the slot of the slowest unchoked one
+	for i, p := range peers {
+		p.download(int64(i) * 100)
+	}
+	peers[0].download(1000)
+	clock.advance(Interval)
+	c.Rechoke()
+	if peers[0].choked() || !peers[2].choked() {
+		t.Errorf("peer 0 choked %t, peer 2 choked %t after peer 0 sped up", peers[0].choked(), peers[2].choked())
+	}
+}
+
+func TestInterestedTakesFreeSlot(t *testing.T) {
+	c := New(&fakeClock{now: time.Unix(1000, 0)})
+	c.Slots = 1
+	first, second := newFakePeer(true), newFakePeer(true)
+	c.Add(first)
+	c.Add(second)
+
+	c.Interested(first)
+	c.Interested(second)
+	if first.choked() || !second.choked() {
+		t.Errorf("first choked %t, second choked %t, want the first one only in the slot", first.choked(), second.choked())
+	}
+}
+
+func TestOptimisticRotation(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	c := New(clock)
+	c.Slots = 0
+	a, b := newFakePeer(true), newFakePeer(true)
+	c.Add(a)
+	c.Add(b)
+
+	unchoked := func() *fakePeer {
+		if !a.choked() && b.choked() {
+			return a
+		}
+		if !b.choked() && a.choked() {
+			return b
+		}
+		t.Fatalf("a choked %t, b choked %t, want exactly one optimistic unchoke", a.choked(), b.choked())
+		return nil
+	}
+
+	c.Rechoke()
+	current := unchoked()
+	rotated := false
+	for i := 0; i < 20 && !rotated; i++ {
+		// The optimistic unchoke holds for OptimisticInterval
+		for elapsed := Interval; elapsed < OptimisticInterval; elapsed += Interval {
+			clock.advance(Interval)
+			c.Rechoke()
+			if unchoked() != current {
+				t.Fatalf("optimistic unchoke moved after %s", elapsed)
+			}
+		}
+		clock.advance(Interval)
+		c.Rechoke()
+		if next := unchoked(); next != current {
+			rotated = true
+		}
+	}
+	if !rotated {
+		t.Errorf("optimistic unchoke never moved to the other peer")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 	"torrent/bitfield"
 	"torrent/handshake"
@@ -11,28 +12,66 @@ import (
 	"torrent/peers"
 )
 
-// A Connection is a TCP connection with a peer
+// State is the protocol state of a connection (BEP 3). Both sides start choking and not interested
+type State struct {
+	AmChoking      bool // we are choking the peer, its requests are not served
+	AmInterested   bool // we told the peer we want some of its pieces
+	PeerChoking    bool // the peer is choking us, our requests are not served
+	PeerInterested bool // the peer wants some of our pieces
+	LastSent       time.Time
+	LastReceived   time.Time
+	Downloaded     int64 // bytes of block data received from the peer
+	Uploaded       int64 // bytes of block data sent to the peer
+}
+
+// A Connection is a TCP connection with a peer, used both to download from and upload to it
 type Connection struct {
 	Conn         net.Conn
-	Choked       bool
 	PeerBitfield bitfield.Bitfield
-	MyBitfield   bitfield.Bitfield
+	PeerReserved [8]byte
 	peer         peers.Peer
 	infoHash     [20]byte
 	ID           [20]byte
+	PeerID       [20]byte // the peer ID the peer sent in its handshake
+
+	// Extensions are the extensions we support on this connection, peerExtensions maps the
+	// extensions the peer supports to the extended message IDs it assigned to them
+	Extensions     *Extensions
+	peerExtensions map[string]uint8
+	peerHandshake  map[string]interface{}
+
+	// extensions may send messages from their own goroutine while a worker is requesting pieces
+	writeMu sync.Mutex
+	stateMu sync.Mutex // guards state, PeerBitfield and what the peer's extended handshake told
+	state   State
 }
 
-func SendUnchoke(conn net.Conn) error {
-	msg := message.Message{ID: message.Unchoke}
-	_, err := conn.Write(msg.Serialize())
-	return err
+// creates a connection in the initial state once the handshake is done, hs being the handshake
+// the peer sent
+func newConnection(conn net.Conn, peer peers.Peer, peerID, infoHash [20]byte, hs *handshake.Handshake, bf bitfield.Bitfield) *Connection {
+	now := time.Now()
+	return &Connection{
+		Conn:         conn,
+		PeerBitfield: bf,
+		PeerReserved: hs.Reserved,
+		PeerID:       hs.PeerID,
+		peer:         peer,
+		infoHash:     infoHash,
+		ID:           peerID,
+		state: State{
+			AmChoking:    true,
+			PeerChoking:  true,
+			LastSent:     now,
+			LastReceived: now,
+		},
+	}
 }
 
-func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Handshake, error) {
+func completeHandshake(conn net.Conn, req *handshake.Handshake) (*handshake.Handshake, error) {
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
 	defer conn.SetDeadline(time.Time{}) // Disable the deadline
 
-	req := handshake.New(infohash, peerID)
+	infohash := req.InfoHash
 	_, err := conn.Write(req.Serialize())
 	if err != nil {
 		return nil, err
@@ -48,100 +87,241 @@ func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Han
 	return res, nil
 }
 
-func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
-	defer conn.SetDeadline(time.Time{}) // Disable the deadline
+// SupportsExtensionProtocol tells if the peer set the extension protocol (BEP 10) bit in its handshake
+func (c *Connection) SupportsExtensionProtocol() bool {
+	h := handshake.Handshake{Reserved: c.PeerReserved}
+	return h.SupportsExtensionProtocol()
+}
 
-	msg, err := message.Read(conn)
+// dials a peer and completes a handshake announcing support for the extension protocol (BEP 10)
+func dial(peer peers.Peer, peerID, infoHash [20]byte) (net.Conn, *handshake.Handshake, error) {
+	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	if msg == nil {
-		err := fmt.Errorf("Expected bitfield but got %s", msg)
-		return nil, err
+
+	req := handshake.New(infoHash, peerID)
+	req.SetExtensionProtocol()
+	res, err := completeHandshake(conn, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
 	}
-	if msg.ID != message.Bitfield {
-		err := fmt.Errorf("Expected bitfield but got ID %d", msg.ID)
+	return conn, res, nil
+}
+
+// NewExtended connects with a peer and completes a handshake announcing support for the
+// extension protocol (BEP 10). It does not wait for a bitfield since the peer might not have any piece yet
+func NewExtended(peer peers.Peer, peerID, infoHash [20]byte) (*Connection, error) {
+	conn, res, err := dial(peer, peerID, infoHash)
+	if err != nil {
 		return nil, err
 	}
+	if !res.SupportsExtensionProtocol() {
+		conn.Close()
+		return nil, fmt.Errorf("peer %s does not support the extension protocol", peer)
+	}
 
-	return msg.Payload, nil
+	return newConnection(conn, peer, peerID, infoHash, res, nil), nil
 }
 
-// NewSeeder connects with a seeder, completes a handshake, and receives a handshake
-func NewSeeder(peer peers.Peer, peerID, infoHash [20]byte) (*Connection, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+// Dial connects with a peer, completes a handshake announcing support for the extension
+// protocol and sends our bitfield. It does not wait for the peer's bitfield, which is
+// applied by Read once it arrives, so peers without any piece can be connected too
+func Dial(peer peers.Peer, peerID, infoHash [20]byte, bf bitfield.Bitfield) (*Connection, error) {
+	conn, res, err := dial(peer, peerID, infoHash)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = completeHandshake(conn, infoHash, peerID)
+	c := newConnection(conn, peer, peerID, infoHash, res, make(bitfield.Bitfield, len(bf)))
+	err = c.Send(&message.Message{ID: message.Bitfield, Payload: bf})
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
+	return c, nil
+}
 
-	bf, err := recvBitfield(conn)
+// Accept completes the handshake of a connection a peer opened to us for infoHash and sends
+// our bitfield
+func Accept(conn net.Conn, peerID, infoHash [20]byte, bf bitfield.Bitfield) (*Connection, error) {
+	peer, err := peers.Parse(conn.RemoteAddr().String())
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
 
-	return &Connection{
-		Conn:         conn,
-		Choked:       true,
-		PeerBitfield: bf,
-		peer:         peer,
-		infoHash:     infoHash,
-		ID:           peerID,
-	}, nil
-}
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetDeadline(time.Time{}) // Disable the deadline
 
-// New comp
-func NewLeecher(peer peers.Peer, peerID, infoHash [20]byte) (*Connection, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+	req, err := handshake.Read(conn)
 	if err != nil {
 		return nil, err
 	}
-
-	_, err = completeHandshake(conn, infoHash, peerID)
+	if req.InfoHash != infoHash {
+		return nil, fmt.Errorf("peer %s asked for infohash %x but we serve %x", peer, req.InfoHash, infoHash)
+	}
+	res := handshake.New(infoHash, peerID)
+	res.SetExtensionProtocol()
+	_, err = conn.Write(res.Serialize())
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
 
-	bf, err := recvBitfield(conn)
+	c := newConnection(conn, peer, peerID, infoHash, req, make(bitfield.Bitfield, len(bf)))
+	err = c.Send(&message.Message{ID: message.Bitfield, Payload: bf})
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
-
-	return &Connection{
-		Conn:         conn,
-		Choked:       true,
-		PeerBitfield: bf,
-		peer:         peer,
-		infoHash:     infoHash,
-		ID:           peerID,
-	}, nil
+	return c, nil
 }
 
-// Read reads and consumes a message from the connection
+// Read reads and consumes a message from the connection. Messages changing the state of the
+// peer (choke, unchoke, interested, not interested, have and bitfield) are applied before
+// being returned
 func (c *Connection) Read() (*message.Message, error) {
 	msg, err := message.Read(c.Conn)
-	return msg, err
+	if err != nil {
+		return nil, err
+	}
+
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.state.LastReceived = time.Now()
+	if msg == nil { // keep-alive
+		return nil, nil
+	}
+	switch msg.ID {
+	case message.Choke:
+		c.state.PeerChoking = true
+	case message.Unchoke:
+		c.state.PeerChoking = false
+	case message.Interested:
+		c.state.PeerInterested = true
+	case message.NotInterested:
+		c.state.PeerInterested = false
+	case message.Have:
+		index, err := message.ParseHave(msg)
+		if err != nil {
+			return nil, err
+		}
+		c.PeerBitfield.SetPiece(index)
+	case message.Bitfield:
+		c.PeerBitfield = append(bitfield.Bitfield{}, msg.Payload...)
+	case message.Piece:
+		if len(msg.Payload) > 8 {
+			c.state.Downloaded += int64(len(msg.Payload) - 8)
+		}
+	}
+	return msg, nil
+}
+
+// PeerHas tells if the peer has a piece. Unlike PeerBitfield.HasPiece it is safe to call
+// while another goroutine reads from the connection
+func (c *Connection) PeerHas(index int) bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.PeerBitfield.HasPiece(index)
+}
+
+// PeerComplete tells if the peer has every one of numPieces pieces, i.e. if it is a seed
+func (c *Connection) PeerComplete(numPieces int) bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	for index := 0; index < numPieces; index++ {
+		if !c.PeerBitfield.HasPiece(index) {
+			return false
+		}
+	}
+	return true
+}
+
+// State returns a snapshot of the protocol state of the connection
+func (c *Connection) State() State {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.state
+}
+
+// Peer returns the address of the peer
+func (c *Connection) Peer() peers.Peer {
+	return c.peer
+}
+
+// Send writes a message to the peer and updates our side of the state for choke, unchoke,
+// interested and not interested. It is safe to call from several goroutines
+func (c *Connection) Send(msg *message.Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write(msg.Serialize())
+	if err != nil {
+		return err
+	}
+
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.state.LastSent = time.Now()
+	if msg == nil {
+		return nil
+	}
+	switch msg.ID {
+	case message.Choke:
+		c.state.AmChoking = true
+	case message.Unchoke:
+		c.state.AmChoking = false
+	case message.Interested:
+		c.state.AmInterested = true
+	case message.NotInterested:
+		c.state.AmInterested = false
+	case message.Piece:
+		if len(msg.Payload) > 8 {
+			c.state.Uploaded += int64(len(msg.Payload) - 8)
+		}
+	}
+	return nil
+}
+
+// SendKeepAlive sends a keep-alive message
+func (c *Connection) SendKeepAlive() error {
+	return c.Send(nil)
 }
 
 // SendRequest sends a Request message to the peer
 func (c *Connection) SendRequest(index, begin, length int) error {
-	req := message.FormatRequest(index, begin, length)
-	_, err := c.Conn.Write(req.Serialize())
-	return err
+	return c.Send(message.FormatRequest(index, begin, length))
 }
 
 // SendUnchoke sends an Unchoke message to the peer
 func (c *Connection) SendUnchoke() error {
-	msg := message.Message{ID: message.Unchoke}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.Send(&message.Message{ID: message.Unchoke})
+}
+
+// SendChoke sends a Choke message to the peer
+func (c *Connection) SendChoke() error {
+	return c.Send(&message.Message{ID: message.Choke})
+}
+
+// SendInterested tells the peer we want some of its pieces
+func (c *Connection) SendInterested() error {
+	return c.Send(&message.Message{ID: message.Interested})
+}
+
+// SendNotInterested tells the peer it has nothing we want
+func (c *Connection) SendNotInterested() error {
+	return c.Send(&message.Message{ID: message.NotInterested})
+}
+
+// SendHave tells the peer we just got a piece
+func (c *Connection) SendHave(index int) error {
+	return c.Send(message.FormatHave(index))
+}
+
+// SendCancel cancels a block previously requested from the peer
+func (c *Connection) SendCancel(index, begin, length int) error {
+	return c.Send(message.FormatCancel(index, begin, length))
+}
+
+// SendExtended sends an extension protocol message with the given extended ID to the peer
+func (c *Connection) SendExtended(id uint8, payload []byte) error {
+	return c.Send(message.FormatExtended(id, payload))
 }
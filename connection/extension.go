@@ -0,0 +1,190 @@
+package connection
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"torrent/message"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// HandshakeID is the extended message ID reserved for the extended handshake (BEP 10)
+const HandshakeID = 0
+
+// An Extension is a protocol extension (ut_metadata, ut_pex, lt_donthave...) riding on BEP 10
+type Extension interface {
+	// Handshake is called once the peer's extended handshake has been received
+	Handshake(c *Connection) error
+	// Handle is called for every extended message the peer sends to this extension
+	Handle(c *Connection, payload []byte) error
+}
+
+// Extensions is a registry of the extensions we support. Every registered extension
+// is assigned the extended message ID peers have to use when sending it messages
+type Extensions struct {
+	ids        map[string]uint8
+	extensions map[uint8]Extension
+	// Fields added to our extended handshake besides m, e.g. metadata_size or reqq
+	Fields map[string]interface{}
+}
+
+// NewExtensions creates an empty registry
+func NewExtensions() *Extensions {
+	return &Extensions{
+		ids:        map[string]uint8{},
+		extensions: map[uint8]Extension{},
+		Fields:     map[string]interface{}{},
+	}
+}
+
+// Register adds an extension to the registry and returns its extended message ID
+func (e *Extensions) Register(name string, ext Extension) uint8 {
+	if id, ok := e.ids[name]; ok {
+		e.extensions[id] = ext
+		return id
+	}
+	id := uint8(len(e.ids) + 1)
+	e.ids[name] = id
+	e.extensions[id] = ext
+	return id
+}
+
+// ID returns the extended message ID assigned to an extension
+func (e *Extensions) ID(name string) (uint8, bool) {
+	id, ok := e.ids[name]
+	return id, ok
+}
+
+// builds the payload of our extended handshake
+func (e *Extensions) handshake() ([]byte, error) {
+	hs := map[string]interface{}{}
+	for key, value := range e.Fields {
+		hs[key] = value
+	}
+	m := map[string]interface{}{}
+	for name, id := range e.ids {
+		m[name] = int(id)
+	}
+	hs["m"] = m
+
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, hs)
+	return buf.Bytes(), err
+}
+
+// names returns the names of the registered extensions in the order of their IDs
+func (e *Extensions) names() []string {
+	names := make([]string, 0, len(e.ids))
+	for name := range e.ids {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return e.ids[names[i]] < e.ids[names[j]] })
+	return names
+}
+
+// SendExtendedHandshake sends our extended handshake advertising every registered extension
+func (c *Connection) SendExtendedHandshake() error {
+	extensions := c.Extensions
+	if extensions == nil {
+		extensions = NewExtensions()
+	}
+	payload, err := extensions.handshake()
+	if err != nil {
+		return err
+	}
+	return c.SendExtended(HandshakeID, payload)
+}
+
+// parses the peer's extended handshake
+func (c *Connection) readExtendedHandshake(payload []byte) error {
+	decoded, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	hs, ok := decoded.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("extended handshake is not a dictionary")
+	}
+
+	ids := map[string]uint8{}
+	if m, ok := hs["m"].(map[string]interface{}); ok {
+		for name, value := range m {
+			id, ok := value.(int64)
+			// an ID of 0 means the peer disabled the extension
+			if !ok || id <= 0 || id > 255 {
+				continue
+			}
+			ids[name] = uint8(id)
+		}
+	}
+	// The peer may send its extended handshake again while extensions are sending messages
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.peerHandshake = hs
+	c.peerExtensions = ids
+	return nil
+}
+
+// HandleExtended routes an extended message either to the extended handshake or to the
+// registered extension it is addressed to. Messages for unknown extensions are ignored
+func (c *Connection) HandleExtended(msg *message.Message) error {
+	id, payload, err := message.ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+
+	if id == HandshakeID {
+		err := c.readExtendedHandshake(payload)
+		if err != nil {
+			return err
+		}
+		if c.Extensions == nil {
+			return nil
+		}
+		for _, name := range c.Extensions.names() {
+			err := c.Extensions.extensions[c.Extensions.ids[name]].Handshake(c)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		return nil
+	}
+
+	if c.Extensions == nil {
+		return nil
+	}
+	ext, ok := c.Extensions.extensions[id]
+	if !ok {
+		return nil
+	}
+	return ext.Handle(c, payload)
+}
+
+// HandshakeInt returns an integer field of the peer's extended handshake, e.g. metadata_size
+func (c *Connection) HandshakeInt(key string) (int, bool) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	value, ok := c.peerHandshake[key].(int64)
+	return int(value), ok
+}
+
+// SupportsExtension tells if the peer advertised an extension in its extended handshake
+func (c *Connection) SupportsExtension(name string) bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	_, ok := c.peerExtensions[name]
+	return ok
+}
+
+// SendExtension sends a message to one of the peer's extensions using the ID the peer assigned to it
+func (c *Connection) SendExtension(name string, payload []byte) error {
+	c.stateMu.Lock()
+	id, ok := c.peerExtensions[name]
+	c.stateMu.Unlock()
+	if !ok {
+		return fmt.Errorf("peer does not support %s", name)
+	}
+	return c.SendExtended(id, payload)
+}
@@ -0,0 +1,515 @@
+// Package dht is a mainline DHT node (BEP 5). It joins the network through
+// DefaultBootstrapNodes, finds the peers of torrents without a working tracker and announces
+// us so that other peers find us. It only speaks IPv4: the IPv6 extension (BEP 32) and its
+// nodes6 lists are not supported
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"torrent/peers"
+)
+
+// DefaultBootstrapNodes are well known routers used to join the mainline DHT
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// QueryTimeout is how long we wait for a node to answer a query
+var QueryTimeout = 2 * time.Second
+
+// RefreshInterval is how often the routing table is refreshed with a lookup of our own ID
+var RefreshInterval = 15 * time.Minute
+
+// Alpha is the number of queries a lookup keeps in flight
+const Alpha = 3
+
+// Config configures a DHT node
+type Config struct {
+	// Addr is the UDP address to listen on, e.g. ":6881"
+	Addr string
+	// BootstrapNodes are contacted to join the DHT, DefaultBootstrapNodes when nil
+	BootstrapNodes []string
+	// ID is our node ID, a random one is picked when zero
+	ID [20]byte
+}
+
+// Server is a mainline DHT node (BEP 5). It answers the queries of other nodes and
+// can look up and announce peers for info-hashes
+type Server struct {
+	conn      *net.UDPConn
+	id        [20]byte
+	bootstrap []string
+	table     *routingTable
+	tokens    *tokenManager
+	store     *peerStore
+
+	mu      sync.Mutex
+	pending map[string]chan *krpcMsg
+	nextTx  uint16
+	closed  chan struct{}
+}
+
+// NewServer starts a DHT node listening on cfg.Addr
+func NewServer(cfg Config) (*Server, error) {
+	id := cfg.ID
+	if id == [20]byte{} {
+		_, err := rand.Read(id[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	bootstrap := cfg.BootstrapNodes
+	if bootstrap == nil {
+		bootstrap = DefaultBootstrapNodes
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		conn:      conn,
+		id:        id,
+		bootstrap: bootstrap,
+		table:     newRoutingTable(id),
+		tokens:    newTokenManager(),
+		store:     newPeerStore(),
+		pending:   map[string]chan *krpcMsg{},
+		closed:    make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.refreshLoop()
+	go s.expireLoop()
+	return s, nil
+}
+
+// ID returns our node ID
+func (s *Server) ID() [20]byte {
+	return s.id
+}
+
+// Addr returns the address the node listens on
+func (s *Server) Addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Nodes returns the number of nodes in the routing table
+func (s *Server) Nodes() int {
+	return s.table.size()
+}
+
+// Close stops the node
+func (s *Server) Close() error {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+	close(s.closed)
+	return s.conn.Close()
+}
+
+func (s *Server) send(msg *krpcMsg, addr *net.UDPAddr) error {
+	buf, err := msg.encode()
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.WriteToUDP(buf, addr)
+	return err
+}
+
+func (s *Server) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+				continue
+			}
+		}
+
+		msg, err := decodeMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		switch msg.Y {
+		case "q":
+			s.handleQuery(msg, addr)
+		case "r", "e":
+			s.mu.Lock()
+			ch, ok := s.pending[msg.T]
+			delete(s.pending, msg.T)
+			s.mu.Unlock()
+			if ok {
+				ch <- msg
+			}
+		}
+	}
+}
+
+// sends a query and waits for the answer. Nodes answering are added to the routing table
+func (s *Server) query(addr *net.UDPAddr, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	s.mu.Lock()
+	s.nextTx++
+	tx := string(binary.BigEndian.AppendUint16(nil, s.nextTx))
+	ch := make(chan *krpcMsg, 1)
+	s.pending[tx] = ch
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, tx)
+		s.mu.Unlock()
+	}()
+
+	args["id"] = string(s.id[:])
+	err := s.send(&krpcMsg{T: tx, Y: "q", Q: method, A: args}, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(QueryTimeout)
+	defer timer.Stop()
+	select {
+	case msg := <-ch:
+		if msg.Y == "e" {
+			return nil, msg.err()
+		}
+		id, ok := idField(msg.R, "id")
+		if !ok {
+			return nil, fmt.Errorf("response from %s has no node ID", addr)
+		}
+		s.table.insert(id, addr)
+		return msg.R, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("query %s to %s timed out", method, addr)
+	case <-s.closed:
+		return nil, fmt.Errorf("dht node closed")
+	}
+}
+
+func (s *Server) reply(msg *krpcMsg, addr *net.UDPAddr, values map[string]interface{}) {
+	values["id"] = string(s.id[:])
+	s.send(&krpcMsg{T: msg.T, Y: "r", R: values}, addr)
+}
+
+func (s *Server) replyError(msg *krpcMsg, addr *net.UDPAddr, code int, message string) {
+	s.send(&krpcMsg{T: msg.T, Y: "e", E: []interface{}{code, message}}, addr)
+}
+
+func (s *Server) handleQuery(msg *krpcMsg, addr *net.UDPAddr) {
+	id, ok := idField(msg.A, "id")
+	if !ok {
+		s.replyError(msg, addr, errProtocol, "missing id")
+		return
+	}
+	s.table.insert(id, addr)
+
+	switch msg.Q {
+	case "ping":
+		s.reply(msg, addr, map[string]interface{}{})
+
+	case "find_node":
+		target, ok := idField(msg.A, "target")
+		if !ok {
+			s.replyError(msg, addr, errProtocol, "missing target")
+			return
+		}
+		s.reply(msg, addr, map[string]interface{}{
+			"nodes": encodeNodes(s.table.closest(target, K)),
+		})
+
+	case "get_peers":
+		infoHash, ok := idField(msg.A, "info_hash")
+		if !ok {
+			s.replyError(msg, addr, errProtocol, "missing info_hash")
+			return
+		}
+		values := map[string]interface{}{"token": s.tokens.token(addr.IP)}
+		if found := s.store.get(infoHash); len(found) > 0 {
+			values["values"] = encodeValues(found)
+		} else {
+			values["nodes"] = encodeNodes(s.table.closest(infoHash, K))
+		}
+		s.reply(msg, addr, values)
+
+	case "announce_peer":
+		infoHash, ok := idField(msg.A, "info_hash")
+		if !ok {
+			s.replyError(msg, addr, errProtocol, "missing info_hash")
+			return
+		}
+		token, _ := msg.A["token"].(string)
+		if !s.tokens.valid(token, addr.IP) {
+			s.replyError(msg, addr, errProtocol, "bad token")
+			return
+		}
+		port, _ := msg.A["port"].(int64)
+		if implied, _ := msg.A["implied_port"].(int64); implied != 0 {
+			port = int64(addr.Port)
+		}
+		if port <= 0 || port > 65535 {
+			s.replyError(msg, addr, errProtocol, "bad port")
+			return
+		}
+		s.store.add(infoHash, peers.Peer{IP: addr.IP, Port: uint16(port)})
+		s.reply(msg, addr, map[string]interface{}{})
+
+	default:
+		s.replyError(msg, addr, errMethod, "Method Unknown")
+	}
+}
+
+// Ping checks that a node is alive and returns its ID
+func (s *Server) Ping(addr *net.UDPAddr) ([20]byte, error) {
+	r, err := s.query(addr, "ping", map[string]interface{}{})
+	if err != nil {
+		return [20]byte{}, err
+	}
+	id, _ := idField(r, "id")
+	return id, nil
+}
+
+// Bootstrap joins the DHT through the bootstrap nodes and fills the routing table
+// with the nodes closest to us
+func (s *Server) Bootstrap() error {
+	contacted := 0
+	for _, host := range s.bootstrap {
+		addr, err := net.ResolveUDPAddr("udp4", host)
+		if err != nil {
+			log.Printf("Could not resolve DHT bootstrap node %s: %s\n", host, err)
+			continue
+		}
+		r, err := s.query(addr, "find_node", map[string]interface{}{"target": string(s.id[:])})
+		if err != nil {
+			log.Printf("DHT bootstrap node %s failed: %s\n", host, err)
+			continue
+		}
+		contacted++
+		if nodes, ok := r["nodes"].(string); ok {
+			found, _ := decodeNodes(nodes)
+			for _, n := range found {
+				// Only nodes that answer us make it into the table
+				go s.Ping(n.addr)
+			}
+		}
+	}
+	if contacted == 0 && s.table.size() == 0 {
+		return fmt.Errorf("none of the %d bootstrap nodes answered", len(s.bootstrap))
+	}
+	s.lookup(s.id, "find_node")
+	return nil
+}
+
+func (s *Server) refreshLoop() {
+	ticker := time.NewTicker(RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			if s.table.size() == 0 {
+				s.Bootstrap()
+				continue
+			}
+			s.lookup(s.id, "find_node")
+		}
+	}
+}
+
+// forgets the expired announced peers every ExpireInterval
+func (s *Server) expireLoop() {
+	ticker := time.NewTicker(ExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			s.store.expire()
+		}
+	}
+}
+
+// lookupResult is what an iterative lookup found
+type lookupResult struct {
+	peers   []peers.Peer
+	closest []*node           // the K closest nodes that answered
+	tokens  map[string]string // get_peers tokens by node address
+}
+
+// lookup walks the DHT towards target, querying Alpha nodes at a time until the K closest
+// nodes known have all been queried. method is either find_node or get_peers
+func (s *Server) lookup(target [20]byte, method string) *lookupResult {
+	result := &lookupResult{tokens: map[string]string{}}
+	candidates := s.table.closest(target, K)
+	seen := map[string]bool{}
+	for _, n := range candidates {
+		seen[n.addr.String()] = true
+	}
+	queried := map[string]bool{}
+	answered := []*node{}
+	foundPeers := map[string]bool{}
+
+	argKey := "target"
+	if method == "get_peers" {
+		argKey = "info_hash"
+	}
+
+	type queryResult struct {
+		n *node
+		r map[string]interface{}
+	}
+
+	for {
+		// Pick the closest candidates that were not queried yet among the K closest
+		sortByDistance(target, candidates)
+		batch := []*node{}
+		for i, n := range candidates {
+			if i >= K || len(batch) >= Alpha {
+				break
+			}
+			if !queried[n.addr.String()] {
+				batch = append(batch, n)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make(chan queryResult, len(batch))
+		for _, n := range batch {
+			queried[n.addr.String()] = true
+			go func(n *node) {
+				r, err := s.query(n.addr, method, map[string]interface{}{argKey: string(target[:])})
+				if err != nil {
+					s.table.failed(n.id)
+					r = nil
+				}
+				results <- queryResult{n, r}
+			}(n)
+		}
+
+		failed := map[string]bool{}
+		for range batch {
+			res := <-results
+			if res.r == nil {
+				failed[res.n.addr.String()] = true
+				continue
+			}
+			answered = append(answered, res.n)
+
+			if token, ok := res.r["token"].(string); ok {
+				result.tokens[res.n.addr.String()] = token
+			}
+			if values, ok := res.r["values"].([]interface{}); ok {
+				for _, peer := range decodeValues(values) {
+					if !foundPeers[peer.String()] {
+						foundPeers[peer.String()] = true
+						result.peers = append(result.peers, peer)
+					}
+				}
+			}
+			if nodes, ok := res.r["nodes"].(string); ok {
+				found, _ := decodeNodes(nodes)
+				for _, n := range found {
+					if n.id == s.id || seen[n.addr.String()] {
+						continue
+					}
+					seen[n.addr.String()] = true
+					candidates = append(candidates, n)
+				}
+			}
+		}
+
+		// Unresponsive nodes must not keep their place among the closest
+		kept := candidates[:0]
+		for _, n := range candidates {
+			if !failed[n.addr.String()] {
+				kept = append(kept, n)
+			}
+		}
+		candidates = kept
+	}
+
+	sortByDistance(target, answered)
+	if len(answered) > K {
+		answered = answered[:K]
+	}
+	result.closest = answered
+	return result
+}
+
+// ensures the routing table has nodes to start a lookup from
+func (s *Server) ready() error {
+	if s.table.size() > 0 {
+		return nil
+	}
+	return s.Bootstrap()
+}
+
+// GetPeers looks up the peers of an info-hash
+func (s *Server) GetPeers(infoHash [20]byte) ([]peers.Peer, error) {
+	err := s.ready()
+	if err != nil {
+		return nil, err
+	}
+	return s.lookup(infoHash, "get_peers").peers, nil
+}
+
+// Announce tells the nodes closest to an info-hash that we have the torrent on port.
+// The peers found along the way are returned
+func (s *Server) Announce(infoHash [20]byte, port uint16) ([]peers.Peer, error) {
+	err := s.ready()
+	if err != nil {
+		return nil, err
+	}
+
+	result := s.lookup(infoHash, "get_peers")
+	announced := 0
+	for _, n := range result.closest {
+		token, ok := result.tokens[n.addr.String()]
+		if !ok {
+			continue
+		}
+		_, err := s.query(n.addr, "announce_peer", map[string]interface{}{
+			"info_hash": string(infoHash[:]),
+			"port":      int(port),
+			"token":     token,
+		})
+		if err == nil {
+			announced++
+		}
+	}
+	if announced == 0 {
+		return result.peers, fmt.Errorf("no DHT node accepted the announce of %x", infoHash)
+	}
+	return result.peers, nil
+}
+
+func sortByDistance(target [20]byte, nodes []*node) {
+	for i := 1; i < len(nodes); i++ {
+		for j := i; j > 0 && closer(target, nodes[j].id, nodes[j-1].id); j-- {
+			nodes[j], nodes[j-1] = nodes[j-1], nodes[j]
+		}
+	}
+}
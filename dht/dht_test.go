@@ -0,0 +1,120 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"torrent/peers"
+)
+
+// starts a node on loopback, joining the DHT through the given nodes
+func newTestServer(t *testing.T, bootstrap ...*Server) *Server {
+	nodes := []string{}
+	for _, b := range bootstrap {
+		nodes = append(nodes, b.Addr().String())
+	}
+	s, err := NewServer(Config{Addr: "127.0.0.1:0", BootstrapNodes: nodes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestPing(t *testing.T) {
+	a := newTestServer(t)
+	b := newTestServer(t)
+
+	id, err := b.Ping(a.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != a.ID() {
+		t.Errorf("got node ID %x, want %x", id, a.ID())
+	}
+	if b.Nodes() != 1 || a.Nodes() != 1 {
+		t.Errorf("routing tables hold %d and %d nodes, want 1 each", a.Nodes(), b.Nodes())
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	router := newTestServer(t)
+	seed := newTestServer(t, router)
+	leech := newTestServer(t, router)
+	infoHash := [20]byte{0xde, 0xad, 0xbe, 0xef}
+
+	_, err := seed.Announce(infoHash, 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := leech.GetPeers(infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].String() != "127.0.0.1:6881" {
+		t.Errorf("got peers %v, want 127.0.0.1:6881", found)
+	}
+}
+
+func TestAnnounceWithBadToken(t *testing.T) {
+	a := newTestServer(t)
+	b := newTestServer(t)
+	infoHash := [20]byte{1}
+
+	_, err := b.query(a.Addr(), "announce_peer", map[string]interface{}{
+		"info_hash": string(infoHash[:]),
+		"port":      6881,
+		"token":     "forged",
+	})
+	var krpcErr *KRPCError
+	if !errors.As(err, &krpcErr) || krpcErr.Code != errProtocol {
+		t.Errorf("got %v, want a protocol error", err)
+	}
+	if found := a.store.get(infoHash); len(found) != 0 {
+		t.Errorf("stored %v despite the bad token", found)
+	}
+}
+
+func TestPeerStoreLimits(t *testing.T) {
+	defer func(swarms, swarmPeers int) {
+		MaxSwarms, MaxSwarmPeers = swarms, swarmPeers
+	}(MaxSwarms, MaxSwarmPeers)
+	MaxSwarms, MaxSwarmPeers = 2, 2
+
+	ps := newPeerStore()
+	for port := uint16(1); port <= 3; port++ {
+		ps.add([20]byte{1}, peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: port})
+	}
+	ps.add([20]byte{2}, peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 1})
+	ps.add([20]byte{3}, peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 1})
+
+	if found := ps.get([20]byte{1}); len(found) != 2 {
+		t.Errorf("stored %d peers in a swarm, want %d", len(found), MaxSwarmPeers)
+	}
+	if len(ps.swarms) != 2 {
+		t.Errorf("stored %d swarms, want %d", len(ps.swarms), MaxSwarms)
+	}
+}
+
+func TestPeerStoreExpire(t *testing.T) {
+	ps := newPeerStore()
+	old := peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	fresh := peers.Peer{IP: net.IPv4(10, 0, 0, 2), Port: 1}
+	ps.add([20]byte{1}, old)
+	ps.add([20]byte{2}, old)
+	ps.add([20]byte{2}, fresh)
+	for _, swarm := range ps.swarms {
+		swarm[old.String()] = storedPeer{peer: old, added: time.Now().Add(-PeerTTL - time.Second)}
+	}
+
+	ps.expire()
+	if _, ok := ps.swarms[[20]byte{1}]; ok {
+		t.Errorf("kept a swarm whose peers all expired")
+	}
+	if swarm := ps.swarms[[20]byte{2}]; len(swarm) != 1 {
+		t.Errorf("kept %v, want the fresh peer only", swarm)
+	}
+}
@@ -0,0 +1,179 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"torrent/peers"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// KRPC error codes (BEP 5)
+const (
+	errGeneric  = 201
+	errServer   = 202
+	errProtocol = 203
+	errMethod   = 204
+)
+
+// krpcMsg is a KRPC query, response or error. Only the fields matching Y are set
+type krpcMsg struct {
+	T string                 // transaction ID
+	Y string                 // "q", "r" or "e"
+	Q string                 // query method
+	A map[string]interface{} // query arguments
+	R map[string]interface{} // response values
+	E []interface{}          // error code and message
+}
+
+// KRPCError is an error returned by a remote node
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+func decodeMessage(buf []byte) (*krpcMsg, error) {
+	decoded, err := bencode.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("krpc message is not a dictionary")
+	}
+
+	msg := krpcMsg{}
+	msg.T, _ = dict["t"].(string)
+	msg.Y, _ = dict["y"].(string)
+	msg.Q, _ = dict["q"].(string)
+	msg.A, _ = dict["a"].(map[string]interface{})
+	msg.R, _ = dict["r"].(map[string]interface{})
+	msg.E, _ = dict["e"].([]interface{})
+
+	switch {
+	case msg.T == "":
+		return nil, fmt.Errorf("krpc message has no transaction ID")
+	case msg.Y == "q" && (msg.Q == "" || msg.A == nil):
+		return nil, fmt.Errorf("malformed krpc query")
+	case msg.Y == "r" && msg.R == nil:
+		return nil, fmt.Errorf("malformed krpc response")
+	case msg.Y != "q" && msg.Y != "r" && msg.Y != "e":
+		return nil, fmt.Errorf("unknown krpc message type %q", msg.Y)
+	}
+	return &msg, nil
+}
+
+func (m *krpcMsg) encode() ([]byte, error) {
+	dict := map[string]interface{}{"t": m.T, "y": m.Y}
+	switch m.Y {
+	case "q":
+		dict["q"] = m.Q
+		dict["a"] = m.A
+	case "r":
+		dict["r"] = m.R
+	case "e":
+		dict["e"] = m.E
+	}
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, dict)
+	return buf.Bytes(), err
+}
+
+// returns the error carried by an "e" message
+func (m *krpcMsg) err() error {
+	krpcErr := &KRPCError{Code: errGeneric, Message: "malformed error"}
+	if len(m.E) == 2 {
+		if code, ok := m.E[0].(int64); ok {
+			krpcErr.Code = int(code)
+		}
+		if message, ok := m.E[1].(string); ok {
+			krpcErr.Message = message
+		}
+	}
+	return krpcErr
+}
+
+// reads a 20 byte ID from a decoded dictionary
+func idField(dict map[string]interface{}, key string) ([20]byte, bool) {
+	var id [20]byte
+	s, ok := dict[key].(string)
+	if !ok || len(s) != 20 {
+		return id, false
+	}
+	copy(id[:], s)
+	return id, true
+}
+
+// encodes nodes in the compact node info format: 20 byte ID, 4 byte IP, 2 byte port
+func encodeNodes(nodes []*node) string {
+	buf := make([]byte, 0, 26*len(nodes))
+	for _, n := range nodes {
+		ip := n.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, n.id[:]...)
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n.addr.Port))
+	}
+	return string(buf)
+}
+
+func decodeNodes(s string) ([]*node, error) {
+	const nodeSize = 26
+	if len(s)%nodeSize != 0 {
+		return nil, fmt.Errorf("malformed compact node info")
+	}
+	nodes := make([]*node, 0, len(s)/nodeSize)
+	for offset := 0; offset < len(s); offset += nodeSize {
+		n := node{}
+		copy(n.id[:], s[offset:offset+20])
+		n.addr = &net.UDPAddr{
+			IP:   net.IP([]byte(s[offset+20 : offset+24])),
+			Port: int(binary.BigEndian.Uint16([]byte(s[offset+24 : offset+26]))),
+		}
+		if n.addr.Port == 0 {
+			continue
+		}
+		nodes = append(nodes, &n)
+	}
+	return nodes, nil
+}
+
+// encodes peers as a list of compact 6 byte strings, as expected in get_peers values
+func encodeValues(found []peers.Peer) []interface{} {
+	values := make([]interface{}, 0, len(found))
+	for _, peer := range found {
+		ip := peer.IP.To4()
+		if ip == nil {
+			continue
+		}
+		value := append([]byte{}, ip...)
+		value = binary.BigEndian.AppendUint16(value, peer.Port)
+		values = append(values, string(value))
+	}
+	return values
+}
+
+func decodeValues(values []interface{}) []peers.Peer {
+	found := []peers.Peer{}
+	for _, value := range values {
+		s, ok := value.(string)
+		if !ok || len(s) != 6 {
+			continue
+		}
+		parsed, err := peers.Unmarshal([]byte(s))
+		if err != nil {
+			continue
+		}
+		found = append(found, parsed...)
+	}
+	return found
+}
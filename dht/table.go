@@ -0,0 +1,148 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// K is the number of nodes kept per bucket and returned by lookups
+const K = 8
+
+// MaxFailures is the number of unanswered queries after which a node is dropped
+const MaxFailures = 2
+
+// StaleAfter is how long a node can stay silent before it can be replaced by a new one
+var StaleAfter = 15 * time.Minute
+
+type node struct {
+	id       [20]byte
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	failures int
+}
+
+// distance returns the XOR distance between two IDs
+func distance(a, b [20]byte) [20]byte {
+	var d [20]byte
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// closer tells if a is closer to target than b
+func closer(target, a, b [20]byte) bool {
+	da, db := distance(target, a), distance(target, b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// routingTable is a Kademlia routing table: bucket i holds the nodes whose ID shares
+// exactly i leading bits with ours
+type routingTable struct {
+	sync.Mutex
+	self    [20]byte
+	buckets [160][]*node
+}
+
+func newRoutingTable(self [20]byte) *routingTable {
+	return &routingTable{self: self}
+}
+
+// returns the bucket of an ID, -1 for our own ID
+func (t *routingTable) bucketIndex(id [20]byte) int {
+	d := distance(t.self, id)
+	for i, b := range d {
+		for bit := 0; bit < 8; bit++ {
+			if b&(0x80>>uint(bit)) != 0 {
+				return i*8 + bit
+			}
+		}
+	}
+	return -1
+}
+
+// insert adds a node that just talked to us or refreshes it. When its bucket is full the
+// node replaces the least recently seen one if that one went stale, otherwise it is dropped
+func (t *routingTable) insert(id [20]byte, addr *net.UDPAddr) {
+	index := t.bucketIndex(id)
+	if index < 0 || addr.IP.To4() == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	bucket := t.buckets[index]
+	for i, n := range bucket {
+		if n.id == id {
+			n.addr = addr
+			n.lastSeen = time.Now()
+			n.failures = 0
+			// Keep the bucket ordered from least to most recently seen
+			t.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), n)
+			return
+		}
+	}
+
+	n := &node{id: id, addr: addr, lastSeen: time.Now()}
+	if len(bucket) < K {
+		t.buckets[index] = append(bucket, n)
+		return
+	}
+	if time.Since(bucket[0].lastSeen) > StaleAfter {
+		t.buckets[index] = append(bucket[1:], n)
+	}
+}
+
+// failed records an unanswered query and drops nodes that stopped answering
+func (t *routingTable) failed(id [20]byte) {
+	index := t.bucketIndex(id)
+	if index < 0 {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	bucket := t.buckets[index]
+	for i, n := range bucket {
+		if n.id == id {
+			n.failures++
+			if n.failures >= MaxFailures {
+				t.buckets[index] = append(bucket[:i:i], bucket[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// closest returns up to count nodes of the table, closest to target first
+func (t *routingTable) closest(target [20]byte, count int) []*node {
+	t.Lock()
+	all := []*node{}
+	for _, bucket := range t.buckets {
+		for _, n := range bucket {
+			copied := *n
+			all = append(all, &copied)
+		}
+	}
+	t.Unlock()
+
+	sort.Slice(all, func(i, j int) bool { return closer(target, all[i].id, all[j].id) })
+	if len(all) > count {
+		all = all[:count]
+	}
+	return all
+}
+
+// size returns the number of nodes in the table
+func (t *routingTable) size() int {
+	t.Lock()
+	defer t.Unlock()
+	total := 0
+	for _, bucket := range t.buckets {
+		total += len(bucket)
+	}
+	return total
+}
@@ -0,0 +1,150 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+
+	"torrent/peers"
+)
+
+// TokenRotation is how often the secret behind get_peers tokens changes. Tokens made with
+// the previous secret are still accepted, so a token lives between one and two rotations
+var TokenRotation = 5 * time.Minute
+
+// PeerTTL is how long an announced peer is kept without being announced again
+var PeerTTL = 30 * time.Minute
+
+// MaxValues is the largest number of peers returned in a get_peers response
+const MaxValues = 50
+
+// MaxSwarms is the largest number of info-hashes we keep announced peers for, and
+// MaxSwarmPeers the largest number of peers kept per info-hash. Announces beyond them are
+// dropped so that other nodes cannot make the store grow without bound
+var (
+	MaxSwarms     = 5000
+	MaxSwarmPeers = 200
+)
+
+// ExpireInterval is how often the expired peers are removed from the store
+var ExpireInterval = 5 * time.Minute
+
+// tokenManager hands out and checks the tokens that announce_peer queries must carry
+type tokenManager struct {
+	sync.Mutex
+	current  [8]byte
+	previous [8]byte
+	rotated  time.Time
+}
+
+func newTokenManager() *tokenManager {
+	tm := &tokenManager{rotated: time.Now()}
+	rand.Read(tm.current[:])
+	tm.previous = tm.current
+	return tm
+}
+
+func (tm *tokenManager) rotate() {
+	if time.Since(tm.rotated) < TokenRotation {
+		return
+	}
+	tm.previous = tm.current
+	rand.Read(tm.current[:])
+	tm.rotated = time.Now()
+}
+
+func tokenFor(secret [8]byte, ip net.IP) string {
+	h := sha1.New()
+	h.Write(secret[:])
+	h.Write(ip.To16())
+	return string(h.Sum(nil))
+}
+
+// token returns the token a node at ip has to send back when announcing
+func (tm *tokenManager) token(ip net.IP) string {
+	tm.Lock()
+	defer tm.Unlock()
+	tm.rotate()
+	return tokenFor(tm.current, ip)
+}
+
+// valid tells if a token was handed out to ip recently enough
+func (tm *tokenManager) valid(token string, ip net.IP) bool {
+	tm.Lock()
+	defer tm.Unlock()
+	tm.rotate()
+	return token == tokenFor(tm.current, ip) || token == tokenFor(tm.previous, ip)
+}
+
+// peerStore keeps the peers announced to us per info-hash
+type peerStore struct {
+	sync.Mutex
+	swarms map[[20]byte]map[string]storedPeer
+}
+
+type storedPeer struct {
+	peer  peers.Peer
+	added time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{swarms: map[[20]byte]map[string]storedPeer{}}
+}
+
+// add stores an announced peer, unless the store or the swarm of infoHash is full. Peers
+// already stored are refreshed
+func (ps *peerStore) add(infoHash [20]byte, peer peers.Peer) {
+	ps.Lock()
+	defer ps.Unlock()
+	swarm, ok := ps.swarms[infoHash]
+	if !ok {
+		if len(ps.swarms) >= MaxSwarms {
+			return
+		}
+		swarm = map[string]storedPeer{}
+		ps.swarms[infoHash] = swarm
+	}
+	addr := peer.String()
+	if _, ok := swarm[addr]; !ok && len(swarm) >= MaxSwarmPeers {
+		return
+	}
+	swarm[addr] = storedPeer{peer: peer, added: time.Now()}
+}
+
+// expire forgets the peers that were not announced again for PeerTTL
+func (ps *peerStore) expire() {
+	ps.Lock()
+	defer ps.Unlock()
+	for infoHash, swarm := range ps.swarms {
+		for addr, stored := range swarm {
+			if time.Since(stored.added) > PeerTTL {
+				delete(swarm, addr)
+			}
+		}
+		if len(swarm) == 0 {
+			delete(ps.swarms, infoHash)
+		}
+	}
+}
+
+// get returns up to MaxValues peers of an info-hash, forgetting the expired ones
+func (ps *peerStore) get(infoHash [20]byte) []peers.Peer {
+	ps.Lock()
+	defer ps.Unlock()
+	found := []peers.Peer{}
+	for addr, stored := range ps.swarms[infoHash] {
+		if time.Since(stored.added) > PeerTTL {
+			delete(ps.swarms[infoHash], addr)
+			continue
+		}
+		if len(found) < MaxValues {
+			found = append(found, stored.peer)
+		}
+	}
+	if len(ps.swarms[infoHash]) == 0 {
+		delete(ps.swarms, infoHash)
+	}
+	return found
+}
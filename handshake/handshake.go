@@ -8,6 +8,7 @@ import (
 // A Handshake is a special message that a peer uses to identify itself
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
@@ -21,13 +22,23 @@ func New(infoHash, peerID [20]byte) *Handshake {
 	}
 }
 
+// SetExtensionProtocol marks the handshake as supporting the extension protocol (BEP 10)
+func (h *Handshake) SetExtensionProtocol() {
+	h.Reserved[5] |= 0x10
+}
+
+// SupportsExtensionProtocol tells if the extension protocol (BEP 10) bit is set
+func (h *Handshake) SupportsExtensionProtocol() bool {
+	return h.Reserved[5]&0x10 != 0
+}
+
 // Serialize serializes the handshake to a buffer
 func (h *Handshake) Serialize() []byte {
 	buf := make([]byte, len(h.Pstr)+49)
 	buf[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8)) // 8 reserved bytes
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 	return buf
@@ -53,13 +64,16 @@ func Read(r io.Reader) (*Handshake, error) {
 		return nil, err
 	}
 
+	var reserved [8]byte
 	var infoHash, peerID [20]byte
 
+	copy(reserved[:], handshakeBuf[pstrlen:pstrlen+8])
 	copy(infoHash[:], handshakeBuf[pstrlen+8:pstrlen+8+20])
 	copy(peerID[:], handshakeBuf[pstrlen+8+20:])
 
 	h := Handshake{
 		Pstr:     string(handshakeBuf[0:pstrlen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
@@ -0,0 +1,152 @@
+package leecher
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+
+	"torrent/peers"
+)
+
+// BanTrust is the trust under which a peer is banned. Every piece failing the integrity
+// check costs the peers that sent blocks of it FailurePenalty, every good piece earns them 1
+var BanTrust = -7
+
+// FailurePenalty is the trust a peer loses for each corrupt piece it sent blocks of
+var FailurePenalty = 2
+
+// MaxTrust caps the trust a peer can save up, so that a peer that behaved for a long time
+// is still banned soon once it starts sending garbage
+var MaxTrust = 20
+
+// banList scores the peers by the pieces they helped download and remembers the banned
+// ones. Peers are known by IP address, a banned peer cannot come back on another port
+type banList struct {
+	mu     sync.Mutex
+	trust  map[string]int
+	banned map[string]net.IP
+}
+
+func newBanList() *banList {
+	return &banList{trust: map[string]int{}, banned: map[string]net.IP{}}
+}
+
+// Ban disconnects from a peer and refuses its connections from now on
+func (t *Leecher) Ban(ip net.IP) {
+	t.ban(ip, "")
+}
+
+// bans a peer, logging why the first time
+func (t *Leecher) ban(ip net.IP, reason string) {
+	t.bans.mu.Lock()
+	_, banned := t.bans.banned[ip.String()]
+	t.bans.banned[ip.String()] = ip
+	t.bans.mu.Unlock()
+	if banned {
+		return
+	}
+	if reason != "" {
+		log.Printf("Banning %s, %s\n", ip, reason)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for s := range t.sessions {
+		if s.conn.Peer().IP.Equal(ip) {
+			go s.close()
+		}
+	}
+}
+
+// Unban lets a banned peer connect again, with a fresh trust
+func (t *Leecher) Unban(ip net.IP) {
+	t.bans.mu.Lock()
+	defer t.bans.mu.Unlock()
+	delete(t.bans.banned, ip.String())
+	delete(t.bans.trust, ip.String())
+}
+
+// Banned returns the banned peers
+func (t *Leecher) Banned() []net.IP {
+	t.bans.mu.Lock()
+	defer t.bans.mu.Unlock()
+	banned := make([]net.IP, 0, len(t.bans.banned))
+	for _, ip := range t.bans.banned {
+		banned = append(banned, ip)
+	}
+	sort.Slice(banned, func(i, j int) bool { return bytes.Compare(banned[i], banned[j]) < 0 })
+	return banned
+}
+
+// IsBanned tells if a peer is banned
+func (t *Leecher) IsBanned(ip net.IP) bool {
+	t.bans.mu.Lock()
+	defer t.bans.mu.Unlock()
+	_, ok := t.bans.banned[ip.String()]
+	return ok
+}
+
+// Trust returns the trust of a peer, 0 for peers that did not send us anything yet
+func (t *Leecher) Trust(ip net.IP) int {
+	t.bans.mu.Lock()
+	defer t.bans.mu.Unlock()
+	return t.bans.trust[ip.String()]
+}
+
+// lowers the trust of the peers that sent blocks of a corrupt piece and bans the ones
+// that went under BanTrust
+func (t *Leecher) pieceFailed(p *partialPiece) {
+	contributors := p.contributors()
+	log.Printf("Piece #%d failed integrity check, its blocks came from %v\n", p.index, contributors)
+	for _, peer := range contributors {
+		if t.addTrust(peer.IP, -FailurePenalty) < BanTrust {
+			t.ban(peer.IP, "too many of the pieces it sent were corrupt")
+		}
+	}
+	t.sched.fail(p)
+}
+
+// raises the trust of the peers that sent blocks of a good piece. If the piece failed
+// before, the peers that sent different data the other times are banned right away (smart
+// ban) and the others get back the trust they lost for it
+func (t *Leecher) piecePassed(p *partialPiece) {
+	culprits, cleared := p.judge()
+	guilty := map[string]bool{}
+	for _, peer := range culprits {
+		guilty[peer.IP.String()] = true
+		t.ban(peer.IP, fmt.Sprintf("it corrupted piece #%d", p.index))
+	}
+	for _, peer := range p.contributors() {
+		if !guilty[peer.IP.String()] {
+			t.addTrust(peer.IP, 1)
+		}
+	}
+	for ip, attempts := range cleared {
+		t.addTrust(net.ParseIP(ip), attempts*FailurePenalty)
+	}
+}
+
+func (t *Leecher) addTrust(ip net.IP, delta int) int {
+	t.bans.mu.Lock()
+	defer t.bans.mu.Unlock()
+	trust := t.bans.trust[ip.String()] + delta
+	if trust > MaxTrust {
+		trust = MaxTrust
+	}
+	t.bans.trust[ip.String()] = trust
+	return trust
+}
+
+// drops the banned peers from a list of peers
+func (t *Leecher) withoutBanned(found []peers.Peer) []peers.Peer {
+	allowed := make([]peers.Peer, 0, len(found))
+	for _, peer := range found {
+		if !t.IsBanned(peer.IP) {
+			allowed = append(allowed, peer)
+		}
+	}
+	return allowed
+}
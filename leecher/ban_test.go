@@ -0,0 +1,79 @@
+package leecher
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"torrent/peers"
+	"torrent/picker"
+)
+
+func newTestLeecher() *Leecher {
+	return &Leecher{
+		bans:     newBanList(),
+		sessions: map[*session]bool{},
+		sched:    newScheduler(picker.New(1, nil), func(int) int { return 2 * MaxBlockSize }),
+	}
+}
+
+// fills the blocks of a piece, block i coming from from[i]
+func fill(p *partialPiece, data []byte, from ...peers.Peer) {
+	copy(p.buf, data)
+	for block := range p.blocks {
+		p.blocks[block].received = true
+		p.blocks[block].from = from[block]
+	}
+	p.received = len(p.blocks)
+}
+
+func TestSmartBan(t *testing.T) {
+	leecher := newTestLeecher()
+	liar := peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	honest := peers.Peer{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+	other := peers.Peer{IP: net.IPv4(10, 0, 0, 3), Port: 6881}
+	good := bytes.Repeat([]byte{1}, 2*MaxBlockSize)
+	corrupt := append(bytes.Repeat([]byte{2}, MaxBlockSize), good[MaxBlockSize:]...)
+
+	// The liar corrupts the first block, the honest peer sends a good second block
+	p := newPartialPiece(0, len(good))
+	fill(p, corrupt, liar, honest)
+	leecher.pieceFailed(p)
+	if leecher.Trust(liar.IP) != -FailurePenalty || leecher.Trust(honest.IP) != -FailurePenalty {
+		t.Errorf("got trust %d and %d after the failure", leecher.Trust(liar.IP), leecher.Trust(honest.IP))
+	}
+
+	// Another peer sends the first block again and the piece passes
+	fill(p, good, other, honest)
+	leecher.piecePassed(p)
+	if banned := leecher.Banned(); len(banned) != 1 || !banned[0].Equal(liar.IP) {
+		t.Errorf("banned %v, want the liar only", banned)
+	}
+	if trust := leecher.Trust(honest.IP); trust != 1 {
+		t.Errorf("honest peer has trust %d, want its penalty back plus 1", trust)
+	}
+	if trust := leecher.Trust(other.IP); trust != 1 {
+		t.Errorf("other peer has trust %d, want 1", trust)
+	}
+}
+
+func TestTrustBan(t *testing.T) {
+	leecher := newTestLeecher()
+	peer := peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	data := bytes.Repeat([]byte{1}, 2*MaxBlockSize)
+
+	failures := 0
+	for !leecher.IsBanned(peer.IP) {
+		p := newPartialPiece(0, len(data))
+		fill(p, data, peer, peer)
+		leecher.pieceFailed(p)
+		failures++
+		if failures > 10 {
+			t.Fatalf("not banned after %d corrupt pieces", failures)
+		}
+	}
+	// Banned once the trust goes under BanTrust
+	if want := -BanTrust/FailurePenalty + 1; failures != want {
+		t.Errorf("banned after %d corrupt pieces, want %d", failures, want)
+	}
+}
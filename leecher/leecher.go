@@ -1,38 +1,98 @@
+// Package leecher downloads a torrent from the swarm, seeding the pieces it has meanwhile.
+//
+// Pieces are downloaded in blocks that any peer having the piece can send, so several peers
+// fill the same piece and a peer disconnecting loses none of the blocks received. Once every
+// missing block is requested the last ones are requested from the other peers too, so that
+// a slow peer does not hold the download at 99%.
+//
+// The requests in flight with each peer follow its rate and round-trip time: twice the
+// bandwidth-delay product keeps the pipe full without queueing more than needed.
+//
+// Peers sending corrupt data lose trust and are banned once under BanTrust. When a piece
+// that failed passes later on, the peers whose blocks differ from the good ones are banned
+// right away
 package leecher
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
 	"fmt"
 	"log"
 	"net"
+	"sync"
 	"time"
 
+	"torrent/choker"
 	"torrent/connection"
-	"torrent/message"
+	"torrent/dht"
+	"torrent/lsd"
+	"torrent/manager"
 	"torrent/peers"
+	"torrent/pex"
+	"torrent/picker"
+	"torrent/seeder"
 	"torrent/torrentfile"
 )
 
 // MaxBlockSize is the largest number of bytes a request can ask for
 const MaxBlockSize = 16384
 
-// MaxRequests is the number of unfulfilled requests a client can queue for
-const MaxRequests = 5
+// DefaultMinRequests is the number of unfulfilled requests sent to a peer before its rate
+// and round-trip time are known
+const DefaultMinRequests = 5
 
-// Leecher holds all the data required to download a torrent from a list of peers
-type Leecher struct {
-	Peers   []peers.Peer
-	PeerID  [20]byte
-	Port    uint16
-	Torrent torrentfile.Torrent
+// DefaultMaxRequests caps the number of unfulfilled requests sent to a peer, peers
+// advertising a smaller reqq get at most that many
+const DefaultMaxRequests = 250
+
+// DHTInterval is how often the DHT is searched for new peers
+var DHTInterval = 5 * time.Minute
+
+// NoPeersTimeout is how long Download waits for new peers once none is left before giving up
+var NoPeersTimeout = 5 * time.Minute
+
+// NoPeersError is returned by Download when no peer is left to download from
+type NoPeersError struct {
+	Missing int // the number of pieces we do not have
+}
+
+func (e *NoPeersError) Error() string {
+	return fmt.Sprintf("no peers left to download the %d missing pieces from", e.Missing)
 }
 
-type pieceWork struct {
-	index  int
-	hash   [20]byte
-	length int
+// Leecher holds all the data required to download a torrent from a list of peers
+type Leecher struct {
+	Peers      []peers.Peer
+	PeerID     [20]byte
+	Port       uint16
+	Torrent    torrentfile.Torrent
+	Extensions *connection.Extensions
+	DHT        *dht.Server
+	LSD        *lsd.Service
+	PEX        *pex.Swarm
+	Choker     *choker.Choker
+	Manager    *manager.Manager
+	// MinRequests and MaxRequests bound the number of unfulfilled requests per peer, which
+	// follows the bandwidth-delay product of the peer in between
+	MinRequests int
+	MaxRequests int
+
+	announcer   *torrentfile.Announcer
+	stop        chan struct{}
+	stopOnce    sync.Once
+	mu          sync.Mutex
+	sessions    map[*session]bool
+	downloading bool
+	done        bool
+	pieces      *picker.Picker
+	sched       *scheduler
+	bans        *banList
+	results     chan *pieceResult
+	finished    chan struct{} // closed once Download returns
+	finishOnce  sync.Once
+	closed      bool
 }
 
 type pieceResult struct {
@@ -40,17 +100,9 @@ type pieceResult struct {
 	buf   []byte
 }
 
-type pieceProgress struct {
-	index      int
-	client     *connection.Connection
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
-}
-
-// Creates a Leecher
-func CreateLeecher(t torrentfile.Torrent, Port uint16) (*Leecher, error) {
+// Creates a Leecher. node and local can be nil, otherwise the DHT and the local network are
+// searched for peers as well and the leecher keeps going when no tracker answers
+func CreateLeecher(t torrentfile.Torrent, Port uint16, node *dht.Server, local *lsd.Service) (*Leecher, error) {
 	var peerID [20]byte
 	_, err := rand.Read(peerID[:])
 	if err != nil {
@@ -59,162 +111,355 @@ func CreateLeecher(t torrentfile.Torrent, Port uint16) (*Leecher, error) {
 
 	log.Printf("Listening on Ip: %s and port : %d", net.IP(peerID[:]).String(), Port)
 
-	peers, err := t.GetPeers(peerID, Port)
-	if err != nil {
-		return nil, err
-	}
-
 	leecher := Leecher{
-		Peers:   peers,
-		PeerID:  peerID,
-		Port:    Port,
-		Torrent: t,
+		PeerID:      peerID,
+		Port:        Port,
+		Torrent:     t,
+		Extensions:  connection.NewExtensions(),
+		MinRequests: DefaultMinRequests,
+		MaxRequests: DefaultMaxRequests,
+		DHT:         node,
+		LSD:         local,
+		sessions:    map[*session]bool{},
+		pieces:      picker.New(len(t.PieceHashes), t.HasPiece),
+		results:     make(chan *pieceResult),
+		bans:        newBanList(),
+		finished:    make(chan struct{}),
+		stop:        make(chan struct{}),
 	}
-	return &leecher, nil
-}
-
-func (state *pieceProgress) readMessage() error {
-	msg, err := state.client.Read() // this call blocks
+	leecher.sched = newScheduler(leecher.pieces, leecher.Torrent.PieceSize)
+	leecher.Manager = manager.New(peerID, leecher.dial)
+	leecher.Choker = choker.New(nil)
+	leecher.Choker.Seeding = leecher.seeding
+	go leecher.Choker.Run(leecher.stop)
+	leecher.PEX = pex.New(len(t.PieceHashes), leecher.AddPeers)
+	leecher.Extensions.Register(pex.Name, leecher.PEX)
+	leecher.Extensions.Fields["reqq"] = seeder.MaxQueuedRequests
+	leecher.announcer = torrentfile.NewAnnouncer(&leecher.Torrent, peerID, Port, leecher.AddPeers)
+
+	peers, err := leecher.announcer.Start()
 	if err != nil {
-		return err
+		if node == nil && local == nil {
+			leecher.Stop()
+			return nil, err
+		}
+		// The announcer keeps retrying the trackers in the background
+		log.Printf("Trackers failed, relying on the DHT and local peers meanwhile: %s\n", err)
 	}
+	leecher.Peers = peers
+	leecher.Manager.Add(peers)
 
-	if msg == nil { // keep-alive
-		return nil
+	if node != nil {
+		go leecher.searchDHT()
 	}
-
-	switch msg.ID {
-	case message.Unchoke:
-		state.client.Choked = false
-	case message.Piece:
-		n, err := message.ParsePiece(state.index, state.buf, msg)
-		if err != nil {
-			return err
-		}
-		state.downloaded += n
-		state.backlog--
+	if local != nil {
+		local.Announce(t.InfoHash, leecher.AddPeers)
 	}
-	return nil
+
+	return &leecher, nil
 }
 
-func attemptDownloadPiece(c *connection.Connection, pw *pieceWork) ([]byte, error) {
-	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
-	}
-	// Setting a deadline helps get unresponsive peers unstuck.
-	// 30 seconds is more than enough time to download a 262 KB piece
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
-
-	for state.downloaded < pw.length {
-		// If unchoked, send requests until we have enough unfulfilled requests
-		if !state.client.Choked {
-			for state.backlog < MaxRequests && state.requested < pw.length {
-				blockSize := MaxBlockSize
-				// Last block might be shorter than the typical block
-				if pw.length-state.requested < blockSize {
-					blockSize = pw.length - state.requested
-				}
-
-				err := c.SendRequest(pw.index, state.requested, blockSize)
-				if err != nil {
-					return nil, err
-				}
-				state.backlog++
-				state.requested += blockSize
-			}
+// announces us into the DHT every DHTInterval, which also finds its peers, until the
+// leecher is stopped
+func (t *Leecher) searchDHT() {
+	ticker := time.NewTicker(DHTInterval)
+	defer ticker.Stop()
+	for {
+		found, err := t.DHT.Announce(t.Torrent.InfoHash, t.Port)
+		if err != nil {
+			log.Printf("DHT announce failed: %s\n", err)
+		}
+		if len(found) > 0 {
+			log.Printf("Found %d peers in the DHT\n", len(found))
+			t.AddPeers(found)
 		}
 
-		err := state.readMessage()
-		if err != nil {
-			return nil, err
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
 		}
 	}
-	return state.buf, nil
 }
 
-func checkIntegrity(pw *pieceWork, buf []byte) error {
-	hash := sha1.Sum(buf)
-	if !bytes.Equal(hash[:], pw.hash[:]) {
-		return fmt.Errorf("index %d failed integrity check", pw.index)
+// AddPeers hands newly discovered peers to the connection manager, which dials them while
+// we are downloading. Once the download is over they are left to connect to us. Banned
+// peers are ignored
+func (t *Leecher) AddPeers(found []peers.Peer) {
+	if t.seeding() {
+		return
 	}
-	return nil
+	t.Manager.Add(t.withoutBanned(found))
+}
+
+// tells if the download is over
+func (t *Leecher) seeding() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.done
 }
 
-func (t *Leecher) startDownloadWorker(peer peers.Peer, workQueue chan *pieceWork, results chan *pieceResult) {
-	c, err := connection.NewSeeder(peer, t.PeerID, t.Torrent.InfoHash)
+// dials a peer for the connection manager
+func (t *Leecher) dial(peer peers.Peer) {
+	if t.IsBanned(peer.IP) {
+		t.Manager.Failed(peer)
+		t.Manager.Remove(peer)
+		return
+	}
+	c, err := connection.Dial(peer, t.PeerID, t.Torrent.InfoHash, t.Torrent.CopyBitfield())
 	if err != nil {
 		log.Printf("Could not handshake with %s. Disconnecting\n", peer.IP)
+		t.Manager.Failed(peer)
+		return
+	}
+	err = t.Manager.Connected(peer, c.PeerID, true)
+	if err != nil {
+		log.Printf("Disconnecting from %s: %s\n", peer, err)
+		c.Conn.Close()
 		return
 	}
-	defer c.Conn.Close()
+	defer t.Manager.Disconnected(peer, c.PeerID)
 	log.Printf("Completed handshake with %s\n", peer.IP)
+	t.runSession(newSession(t, c, true))
+}
 
-	for pw := range workQueue {
-		if !c.PeerBitfield.HasPiece(pw.index) {
-			workQueue <- pw // Put piece back on the queue
-			continue
-		}
+// Accept takes over a connection a peer opened to us, e.g. from seeder.Serve
+func (t *Leecher) Accept(conn net.Conn) {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && t.IsBanned(addr.IP) {
+		conn.Close()
+		return
+	}
+	c, err := connection.Accept(conn, t.PeerID, t.Torrent.InfoHash, t.Torrent.CopyBitfield())
+	if err != nil {
+		log.Printf("Could not handshake with %s: %s\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	err = t.Manager.Connected(c.Peer(), c.PeerID, false)
+	if err != nil {
+		log.Printf("Disconnecting from %s: %s\n", c.Peer(), err)
+		conn.Close()
+		return
+	}
+	defer t.Manager.Disconnected(c.Peer(), c.PeerID)
+	t.runSession(newSession(t, c, false))
+}
 
-		// Download the piece
-		buf, err := attemptDownloadPiece(c, pw)
-		if err != nil {
-			log.Println("Exiting", err)
-			workQueue <- pw // Put piece back on the queue
-			return
-		}
+// runs a session until the connection breaks, downloading from it whenever we are downloading
+func (t *Leecher) runSession(s *session) {
+	// The peer may have been banned while we were shaking hands
+	if t.IsBanned(s.conn.Peer().IP) {
+		s.close()
+		return
+	}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		s.close()
+		return
+	}
+	t.sessions[s] = true
+	if t.downloading {
+		go s.download()
+	}
+	t.mu.Unlock()
 
-		err = checkIntegrity(pw, buf)
-		if err != nil {
-			log.Printf("Piece #%d failed integrity check\n", pw.index)
-			workQueue <- pw // Put piece back on the queue
-			continue
-		}
+	defer func() {
+		t.mu.Lock()
+		delete(t.sessions, s)
+		t.mu.Unlock()
+	}()
 
-		results <- &pieceResult{pw.index, buf}
+	// Strict peers only unchoke the peers telling them they are interested
+	err := t.updateInterest(s.conn)
+	if err != nil {
+		s.close()
+		return
 	}
+	s.run()
 }
 
-// Download downloads the torrent. This writes to the file as soon as the piece is downloaded.
-func (t *Leecher) Download() error {
-	downloaded := 0
+// Stop tells the trackers that we are leaving the swarm and stops searching the DHT and
+// the local network
+func (t *Leecher) Stop() {
+	t.announcer.Stop()
+	if t.LSD != nil {
+		t.LSD.Remove(t.Torrent.InfoHash)
+	}
+	t.stopOnce.Do(func() { close(t.stop) })
+}
+
+// Close leaves the swarm: it stops announcing us, which sends the stopped event to the
+// trackers, closes every connection and flushes the files to the disk
+func (t *Leecher) Close() error {
+	t.Stop()
+
+	t.mu.Lock()
+	t.closed = true
+	t.downloading = false
+	sessions := make([]*session, 0, len(t.sessions))
+	for s := range t.sessions {
+		sessions = append(sessions, s)
+	}
+	t.mu.Unlock()
+	for _, s := range sessions {
+		s.close()
+	}
+
+	return t.Torrent.Sync()
+}
 
-	workQueue := make(chan *pieceWork, len(t.Torrent.PieceHashes))
-	results := make(chan *pieceResult)
-	for index, hash := range t.Torrent.PieceHashes {
-		length := t.Torrent.PieceSize(index)
+// tells if we are connected to a peer or may soon be
+func (t *Leecher) hasPeers() bool {
+	t.mu.Lock()
+	connected := len(t.sessions) > 0
+	t.mu.Unlock()
+	return connected || !t.Manager.Idle()
+}
 
-		pieceWork := pieceWork{index, hash, length}
+func (t *Leecher) finish() {
+	t.finishOnce.Do(func() { close(t.finished) })
+}
 
-		if t.Torrent.Bitfield.HasPiece(index) {
+// stops downloading because of err, leaving the swarm
+func (t *Leecher) abort(err error) error {
+	t.finish()
+	closeErr := t.Close()
+	if closeErr != nil {
+		log.Printf("Could not flush the files: %s\n", closeErr)
+	}
+	return err
+}
+
+func checkIntegrity(index int, expected [20]byte, buf []byte) error {
+	hash := sha1.Sum(buf)
+	if !bytes.Equal(hash[:], expected[:]) {
+		return fmt.Errorf("index %d failed integrity check", index)
+	}
+	return nil
+}
+
+// tells the peer whether it has pieces we still need
+func (t *Leecher) updateInterest(c *connection.Connection) error {
+	wanted := false
+	for index := range t.Torrent.PieceHashes {
+		if c.PeerHas(index) && !t.Torrent.HasPiece(index) {
+			wanted = true
+			break
+		}
+	}
+
+	interested := c.State().AmInterested
+	switch {
+	case wanted && !interested:
+		return c.SendInterested()
+	case !wanted && interested:
+		return c.SendNotInterested()
+	}
+	return nil
+}
+
+// marks a verified piece as ours and tells every connected peer about it. Peers that had
+// nothing else we need are told we are no longer interested
+func (t *Leecher) havePiece(index int) {
+	t.Torrent.SetPiece(index)
+	t.pieces.Done(index)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for s := range t.sessions {
+		go func(c *connection.Connection) {
+			c.SendHave(index)
+			if c.State().AmInterested {
+				t.updateInterest(c)
+			}
+		}(s.conn)
+	}
+}
+
+// Download downloads the torrent. This writes to the file as soon as the piece is downloaded.
+// Once every piece is there it returns nil and the connections stay open to seed. When ctx
+// is done, or no peer is left for NoPeersTimeout (a *NoPeersError), it leaves the swarm
+// like Close does and returns why
+func (t *Leecher) Download(ctx context.Context) error {
+	downloaded := 0
+	for index := range t.Torrent.PieceHashes {
+		if t.Torrent.HasPiece(index) {
 			downloaded += 1
-		} else {
-			workQueue <- &pieceWork
 		}
 	}
 
-	// Start workers
-	for _, peer := range t.Peers {
-		go t.startDownloadWorker(peer, workQueue, results)
+	startedComplete := downloaded == len(t.Torrent.PieceHashes)
+
+	if startedComplete {
+		log.Printf("Already complete, seeding\n")
+		t.mu.Lock()
+		t.done = true
+		t.mu.Unlock()
+		t.finish()
+		return nil
 	}
 
+	// Download from the peers already connected, peers connected from now on download as well
+	t.mu.Lock()
+	t.downloading = true
+	for s := range t.sessions {
+		go s.download()
+	}
+	t.mu.Unlock()
+	go t.Manager.Run(t.finished)
+
+	check := time.NewTicker(time.Second)
+	defer check.Stop()
+	var alone time.Time // since when no peer is left
 	for downloaded < len(t.Torrent.PieceHashes) {
-		res := <-results
+		var res *pieceResult
+		select {
+		case <-ctx.Done():
+			return t.abort(ctx.Err())
+		case <-check.C:
+			switch {
+			case t.hasPeers():
+				alone = time.Time{}
+			case alone.IsZero():
+				alone = time.Now()
+			case time.Since(alone) >= NoPeersTimeout:
+				return t.abort(&NoPeersError{Missing: len(t.Torrent.PieceHashes) - downloaded})
+			}
+			continue
+		case res = <-t.results:
+		}
+		if t.Torrent.HasPiece(res.index) {
+			continue // two peers finished the same piece in endgame mode
+		}
 		begin, _ := t.Torrent.PieceBound(res.index)
 
 		// Write to file as soon as it is downloaded
-		_, err := t.Torrent.File.WriteAt(res.buf, int64(begin))
+		_, err := t.Torrent.WriteAt(res.buf, int64(begin))
 		if err != nil {
-			return err
+			return t.abort(err)
 		}
+		t.havePiece(res.index)
+		t.Torrent.Stats.AddDownloaded(len(res.buf))
 		downloaded++
 
 		log.Printf("(%0.2f%%) Downloaded\n", float64(downloaded)/float64(len(t.Torrent.PieceHashes))*100)
 	}
 	log.Printf("Finished Downloading\n")
-	close(workQueue)
+	t.mu.Lock()
+	t.downloading = false
+	t.done = true
+	sessions := make([]*session, 0, len(t.sessions))
+	for s := range t.sessions {
+		sessions = append(sessions, s)
+	}
+	t.mu.Unlock()
+	t.finish()
+
+	// The connections stay open so that the peers can keep downloading from us
+	for _, s := range sessions {
+		t.updateInterest(s.conn)
+	}
+	t.announcer.Completed()
 
 	return nil
 }
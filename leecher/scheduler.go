@@ -0,0 +1,335 @@
+package leecher
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"torrent/message"
+	"torrent/peers"
+	"torrent/picker"
+)
+
+// blockState is what we know about a block of a piece being downloaded
+type blockState struct {
+	received  bool
+	from      peers.Peer             // the peer that sent the block, blamed if the piece is corrupt
+	requested map[*session]time.Time // the sessions waiting for the block, with when they asked
+}
+
+// partialPiece is a piece being downloaded. Any peer having the piece can send its blocks
+// and the blocks received so far are kept when a peer goes away
+type partialPiece struct {
+	index    int
+	buf      []byte
+	blocks   []blockState
+	received int
+	failures int
+	suspects [][]suspect // per block, what each peer sent in the attempts that failed
+}
+
+// suspect is a block a peer sent for a piece that failed the integrity check
+type suspect struct {
+	from    peers.Peer
+	hash    [20]byte
+	attempt int
+}
+
+func newPartialPiece(index, length int) *partialPiece {
+	return &partialPiece{
+		index:  index,
+		buf:    make([]byte, length),
+		blocks: make([]blockState, (length+MaxBlockSize-1)/MaxBlockSize),
+	}
+}
+
+// the data of a block
+func (p *partialPiece) block(block int) []byte {
+	begin := block * MaxBlockSize
+	return p.buf[begin : begin+p.blockLength(block)]
+}
+
+// contributors returns the peers that sent blocks of the piece
+func (p *partialPiece) contributors() []peers.Peer {
+	contributors := []peers.Peer{}
+	seen := map[string]bool{}
+	for block := range p.blocks {
+		from := p.blocks[block].from
+		if p.blocks[block].received && !seen[from.IP.String()] {
+			seen[from.IP.String()] = true
+			contributors = append(contributors, from)
+		}
+	}
+	return contributors
+}
+
+// judge compares the blocks of a piece that passed the integrity check with the ones sent
+// in the attempts that failed. The peers that sent different data corrupted the piece, the
+// others are cleared of the attempts they took part in
+func (p *partialPiece) judge() (culprits []peers.Peer, cleared map[string]int) {
+	guilty := map[string]peers.Peer{}
+	attempts := map[string]map[int]bool{}
+	for block, suspects := range p.suspects {
+		good := sha1.Sum(p.block(block))
+		for _, suspect := range suspects {
+			ip := suspect.from.IP.String()
+			if suspect.hash != good {
+				guilty[ip] = suspect.from
+			}
+			if attempts[ip] == nil {
+				attempts[ip] = map[int]bool{}
+			}
+			attempts[ip][suspect.attempt] = true
+		}
+	}
+	cleared = map[string]int{}
+	for ip, taken := range attempts {
+		if _, ok := guilty[ip]; !ok {
+			cleared[ip] = len(taken)
+		}
+	}
+	for _, peer := range guilty {
+		culprits = append(culprits, peer)
+	}
+	return culprits, cleared
+}
+
+// the length of a block, the last block might be shorter than the typical block
+func (p *partialPiece) blockLength(block int) int {
+	begin := block * MaxBlockSize
+	if len(p.buf)-begin < MaxBlockSize {
+		return len(p.buf) - begin
+	}
+	return MaxBlockSize
+}
+
+// blockRequest is a request message we sent or are about to send
+type blockRequest struct {
+	index, begin, length int
+}
+
+// blockCancel is a request of another session made useless by a block we received
+type blockCancel struct {
+	session *session
+	blockRequest
+}
+
+// scheduler hands out the blocks of the pieces being downloaded to the peers. Pieces are
+// taken from the picker once the partial pieces the peer has are fully requested, and in
+// endgame mode blocks already requested from slow peers are requested from others too
+type scheduler struct {
+	pieces *picker.Picker
+	length func(index int) int
+
+	mu       sync.Mutex
+	partials map[int]*partialPiece
+	inflight map[*session]map[blockRequest]time.Time
+	changed  chan struct{}
+}
+
+func newScheduler(pieces *picker.Picker, length func(index int) int) *scheduler {
+	return &scheduler{
+		pieces:   pieces,
+		length:   length,
+		partials: map[int]*partialPiece{},
+		inflight: map[*session]map[blockRequest]time.Time{},
+		changed:  make(chan struct{}),
+	}
+}
+
+// Changed returns a channel closed the next time requested blocks are given up
+func (sc *scheduler) Changed() <-chan struct{} {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.changed
+}
+
+func (sc *scheduler) notify() {
+	close(sc.changed)
+	sc.changed = make(chan struct{})
+}
+
+// request returns the blocks to request from a session for it to have depth requests in
+// flight, and records them as requested
+func (sc *scheduler) request(s *session, depth int) []blockRequest {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	// Once choked or closed, the peer drops our requests
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+	if s.conn.State().PeerChoking {
+		return nil
+	}
+
+	inflight := sc.inflight[s]
+	if inflight == nil {
+		inflight = map[blockRequest]time.Time{}
+		sc.inflight[s] = inflight
+	}
+	requests := []blockRequest{}
+	now := time.Now()
+	add := func(p *partialPiece, block int) {
+		req := blockRequest{p.index, block * MaxBlockSize, p.blockLength(block)}
+		if p.blocks[block].requested == nil {
+			p.blocks[block].requested = map[*session]time.Time{}
+		}
+		p.blocks[block].requested[s] = now
+		inflight[req] = now
+		requests = append(requests, req)
+	}
+	full := func() bool {
+		return len(inflight) >= depth
+	}
+
+	// Finishing the pieces already started comes first
+	for _, p := range sc.partials {
+		if full() {
+			return requests
+		}
+		if !s.conn.PeerHas(p.index) {
+			continue
+		}
+		for block := range p.blocks {
+			if full() {
+				break
+			}
+			if !p.blocks[block].received && len(p.blocks[block].requested) == 0 {
+				add(p, block)
+			}
+		}
+	}
+
+	for !full() {
+		index, ok := sc.pieces.Pick(s.conn.PeerHas)
+		if !ok {
+			break
+		}
+		p := newPartialPiece(index, sc.length(index))
+		sc.partials[index] = p
+		for block := range p.blocks {
+			if full() {
+				break
+			}
+			add(p, block)
+		}
+	}
+	if full() || !sc.pieces.Endgame() {
+		return requests
+	}
+
+	// Endgame mode: every block is requested, the peer can race the others for theirs
+	for _, p := range sc.partials {
+		if !s.conn.PeerHas(p.index) {
+			continue
+		}
+		for block := range p.blocks {
+			if full() {
+				return requests
+			}
+			state := p.blocks[block]
+			if _, ok := state.requested[s]; !state.received && !ok {
+				add(p, block)
+			}
+		}
+	}
+	return requests
+}
+
+// receive stores a block sent by a session. It returns when the session requested it, the
+// piece once all its blocks are there, and the requests other sessions made for the block,
+// which are to be cancelled. Blocks of pieces not being downloaded are ignored
+func (sc *scheduler) receive(s *session, msg *message.Message) (sentAt time.Time, done *partialPiece, cancels []blockCancel, err error) {
+	if len(msg.Payload) < 8 {
+		return sentAt, nil, nil, fmt.Errorf("Payload too short. %d < 8", len(msg.Payload))
+	}
+	index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	req := blockRequest{index, begin, len(msg.Payload) - 8}
+	sentAt = sc.inflight[s][req]
+	delete(sc.inflight[s], req)
+
+	p := sc.partials[index]
+	if p == nil || begin%MaxBlockSize != 0 || begin/MaxBlockSize >= len(p.blocks) {
+		return sentAt, nil, nil, nil
+	}
+	block := begin / MaxBlockSize
+	state := &p.blocks[block]
+	if state.received || req.length != p.blockLength(block) {
+		return sentAt, nil, nil, nil
+	}
+	_, err = message.ParsePiece(index, p.buf, msg)
+	if err != nil {
+		return sentAt, nil, nil, err
+	}
+	state.received = true
+	state.from = s.conn.Peer()
+	p.received++
+
+	for other := range state.requested {
+		if other != s {
+			cancels = append(cancels, blockCancel{other, req})
+			delete(sc.inflight[other], req)
+		}
+	}
+	state.requested = nil
+
+	if p.received == len(p.blocks) {
+		delete(sc.partials, index)
+		done = p
+	}
+	return sentAt, done, cancels, nil
+}
+
+// fail puts back a piece that failed the integrity check with all its blocks missing. What
+// each peer sent is remembered to find out who corrupted it once the piece passes
+func (sc *scheduler) fail(p *partialPiece) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if p.suspects == nil {
+		p.suspects = make([][]suspect, len(p.blocks))
+	}
+	p.failures++
+	for block := range p.blocks {
+		p.suspects[block] = append(p.suspects[block], suspect{p.blocks[block].from, sha1.Sum(p.block(block)), p.failures})
+		p.blocks[block] = blockState{}
+	}
+	p.received = 0
+	sc.partials[p.index] = p
+	sc.notify()
+}
+
+// drop gives up the requests of a session that was choked or closed, other peers can then
+// request the blocks
+func (sc *scheduler) drop(s *session) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for req := range sc.inflight[s] {
+		if p := sc.partials[req.index]; p != nil {
+			delete(p.blocks[req.begin/MaxBlockSize].requested, s)
+		}
+	}
+	delete(sc.inflight, s)
+	sc.notify()
+}
+
+// oldest returns when the oldest request of a session in flight was sent, zero if none
+func (sc *scheduler) oldest(s *session) time.Time {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	oldest := time.Time{}
+	for _, sentAt := range sc.inflight[s] {
+		if oldest.IsZero() || sentAt.Before(oldest) {
+			oldest = sentAt
+		}
+	}
+	return oldest
+}
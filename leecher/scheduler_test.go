@@ -0,0 +1,65 @@
+package leecher
+
+import (
+	"bytes"
+	"testing"
+
+	"torrent/bitfield"
+	"torrent/connection"
+	"torrent/message"
+	"torrent/picker"
+)
+
+// a session with a peer that has every piece and does not choke us
+func newTestSession() *session {
+	c := &connection.Connection{PeerBitfield: bitfield.Bitfield{0xff}}
+	return &session{conn: c, closed: make(chan struct{})}
+}
+
+func TestEndgameCancelsDuplicates(t *testing.T) {
+	// A single piece of two blocks, so the first pick starts the endgame
+	pieceLength := 2 * MaxBlockSize
+	sc := newScheduler(picker.New(1, nil), func(int) int { return pieceLength })
+	fast, slow := newTestSession(), newTestSession()
+
+	if requests := sc.request(slow, 10); len(requests) != 2 {
+		t.Fatalf("slow peer got %d requests, want both blocks", len(requests))
+	}
+	// Every block is requested, the other peer races the slow one for them
+	if requests := sc.request(fast, 10); len(requests) != 2 {
+		t.Fatalf("fast peer got %d requests in endgame, want both blocks", len(requests))
+	}
+
+	data := bytes.Repeat([]byte{7}, pieceLength)
+	_, done, cancels, err := sc.receive(fast, message.FormatPiece(0, 0, data[:MaxBlockSize]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done != nil {
+		t.Errorf("piece done after one block")
+	}
+	want := blockCancel{slow, blockRequest{0, 0, MaxBlockSize}}
+	if len(cancels) != 1 || cancels[0] != want {
+		t.Errorf("got cancels %v, want %v", cancels, want)
+	}
+	if _, ok := sc.inflight[slow][want.blockRequest]; ok {
+		t.Errorf("cancelled request still in flight")
+	}
+
+	// The slow peer's copy arriving late is ignored
+	_, done, cancels, err = sc.receive(slow, message.FormatPiece(0, 0, data[:MaxBlockSize]))
+	if err != nil || done != nil || len(cancels) != 0 {
+		t.Errorf("late duplicate gave done %v, cancels %v, error %v", done, cancels, err)
+	}
+
+	_, done, cancels, err = sc.receive(fast, message.FormatPiece(0, MaxBlockSize, data[MaxBlockSize:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done == nil || !bytes.Equal(done.buf, data) {
+		t.Errorf("piece not assembled")
+	}
+	if len(cancels) != 1 || cancels[0].session != slow {
+		t.Errorf("got cancels %v, want the slow peer's second request", cancels)
+	}
+}
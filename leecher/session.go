@@ -0,0 +1,325 @@
+package leecher
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"torrent/connection"
+	"torrent/message"
+	"torrent/pex"
+	"torrent/seeder"
+)
+
+// RequestTimeout is how long a peer has to send a block we requested once unchoked.
+// Peers that take longer are snubbing us and we hang up
+var RequestTimeout = 30 * time.Second
+
+// KeepAliveInterval is how often a keep-alive is sent on connections that are otherwise silent
+var KeepAliveInterval = 2 * time.Minute
+
+// IdleTimeout is how long a peer can stay silent before we hang up
+var IdleTimeout = 3 * time.Minute
+
+// RateWindow is how long blocks are counted before the download rate of a peer is updated
+var RateWindow = time.Second
+
+// session is a connection with a peer, whether we dialed it or it dialed us. Pieces are
+// downloaded from the peer while we are downloading and its requests are served all along
+type session struct {
+	leecher  *Leecher
+	conn     *connection.Connection
+	outgoing bool
+	uploads  *seeder.RequestQueue
+
+	notify chan struct{} // signals the download loop that the connection state changed
+
+	// what the request queue depth is computed from
+	mu          sync.Mutex
+	reqq        int           // the most requests the peer queues, 0 when not advertised
+	rtt         time.Duration // the fastest a block ever came back
+	rate        float64       // bytes per second, smoothed
+	windowBytes int
+	windowStart time.Time
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newSession(t *Leecher, c *connection.Connection, outgoing bool) *session {
+	return &session{
+		leecher:  t,
+		conn:     c,
+		outgoing: outgoing,
+		uploads:  seeder.NewRequestQueue(),
+		notify:   make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+// close hangs up, which makes the read loop and the download loop return. The blocks
+// requested from the peer can then be requested from others
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.conn.Conn.Close()
+		s.leecher.sched.drop(s)
+	})
+}
+
+func (s *session) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run sets the session up and reads from the peer until the connection breaks
+func (s *session) run() {
+	t := s.leecher
+	c := s.conn
+	defer s.close()
+
+	if s.outgoing {
+		// We reached the peer ourselves, so other peers can reach it too. Incoming peers are
+		// not shared: their address holds the port they connected from, not one they listen on
+		t.PEX.Add(c, pex.FlagReachable)
+	}
+	defer t.PEX.Drop(c)
+
+	t.Choker.Add(c)
+	defer t.Choker.Remove(c)
+
+	// The bitfield may have come with the handshake, have and bitfield messages update it
+	t.pieces.SetBitfield(c, c.PeerBitfield)
+	defer t.pieces.RemovePeer(c)
+
+	if c.SupportsExtensionProtocol() {
+		c.Extensions = t.Extensions
+		err := c.SendExtendedHandshake()
+		if err != nil {
+			log.Printf("Could not send extended handshake to %s. Disconnecting\n", c.Peer())
+			return
+		}
+	}
+
+	go s.uploads.Serve(&t.Torrent, c, s.closed)
+	go s.keepAlive()
+
+	err := s.readLoop()
+	if err != nil {
+		log.Printf("Disconnecting from %s: %s\n", c.Peer(), err)
+	}
+}
+
+func (s *session) keepAlive() {
+	ticker := time.NewTicker(KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+		if time.Since(s.conn.State().LastSent) >= KeepAliveInterval {
+			s.conn.SendKeepAlive()
+		}
+	}
+}
+
+func (s *session) readLoop() error {
+	c := s.conn
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(IdleTimeout))
+		msg, err := c.Read() // this call blocks
+		if err != nil {
+			return err
+		}
+		if msg == nil { // keep-alive
+			continue
+		}
+
+		// Read already applied choke, unchoke, interested, have and bitfield to the connection state
+		state := c.State()
+		switch msg.ID {
+		case message.Interested:
+			// Not interested peers are choked by the choker on its next round
+			err = s.leecher.Choker.Interested(c)
+		case message.Request:
+			// Requests sent while choked are discarded
+			if !state.AmChoking {
+				s.uploads.Push(msg)
+			}
+		case message.Cancel:
+			s.uploads.Cancel(msg)
+		case message.Choke:
+			s.choked()
+		case message.Piece:
+			err = s.receiveBlock(msg)
+		case message.Have:
+			var index int
+			index, err = message.ParseHave(msg)
+			if err == nil {
+				s.leecher.pieces.Have(c, index)
+				err = s.leecher.updateInterest(c)
+			}
+		case message.Bitfield:
+			s.leecher.pieces.SetBitfield(c, c.PeerBitfield)
+			err = s.leecher.updateInterest(c)
+		case message.Extended:
+			err = c.HandleExtended(msg)
+			if reqq, ok := c.HandshakeInt("reqq"); ok && err == nil {
+				s.mu.Lock()
+				s.reqq = reqq
+				s.mu.Unlock()
+			}
+		}
+		if err != nil {
+			return err
+		}
+		s.signal()
+	}
+}
+
+// the peer dropped our pending requests, the blocks are requested again once unchoked
+func (s *session) choked() {
+	s.leecher.sched.drop(s)
+}
+
+// stores a block of a piece being downloaded, cancels the requests other peers got for it in
+// endgame mode and hands the piece over once complete
+func (s *session) receiveBlock(msg *message.Message) error {
+	t := s.leecher
+	sentAt, done, cancels, err := t.sched.receive(s, msg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.measure(sentAt, len(msg.Payload)-8)
+	s.mu.Unlock()
+
+	for _, c := range cancels {
+		c.session.conn.SendCancel(c.index, c.begin, c.length)
+		c.session.signal()
+	}
+	if done == nil {
+		return nil
+	}
+
+	err = checkIntegrity(done.index, t.Torrent.PieceHashes[done.index], done.buf)
+	if err != nil {
+		t.pieceFailed(done)
+		return nil
+	}
+	t.piecePassed(done)
+	select {
+	case t.results <- &pieceResult{done.index, done.buf}:
+	case <-t.finished:
+	}
+	return nil
+}
+
+// updates the round-trip time and the download rate with a block requested at sentAt.
+// s.mu must be held
+func (s *session) measure(sentAt time.Time, n int) {
+	now := time.Now()
+	if !sentAt.IsZero() {
+		// The minimum leaves out the time requests wait in the peer's queue, which grows
+		// with the queue depth
+		rtt := now.Sub(sentAt)
+		if s.rtt == 0 || rtt < s.rtt {
+			s.rtt = rtt
+		}
+	}
+
+	if s.windowStart.IsZero() {
+		s.windowStart = now
+	}
+	s.windowBytes += n
+	elapsed := now.Sub(s.windowStart)
+	if elapsed < RateWindow {
+		return
+	}
+	rate := float64(s.windowBytes) / elapsed.Seconds()
+	if s.rate == 0 {
+		s.rate = rate
+	} else {
+		s.rate = 0.7*s.rate + 0.3*rate
+	}
+	s.windowBytes = 0
+	s.windowStart = now
+}
+
+// queueDepth is the number of unfulfilled requests to keep sending the peer: twice its
+// bandwidth-delay product in blocks, so that the depth keeps up while the rate grows.
+// s.mu must be held
+func (s *session) queueDepth() int {
+	t := s.leecher
+	depth := t.MinRequests
+	if s.rtt > 0 && s.rate > 0 {
+		bdp := int(2*s.rate*s.rtt.Seconds()/MaxBlockSize) + 1
+		if bdp > depth {
+			depth = bdp
+		}
+	}
+	if depth > t.MaxRequests {
+		depth = t.MaxRequests
+	}
+	if s.reqq > 0 && depth > s.reqq {
+		depth = s.reqq
+	}
+	if depth < 1 {
+		depth = 1
+	}
+	return depth
+}
+
+// download keeps the queue of requests to the peer full until the download is over
+func (s *session) download() {
+	t := s.leecher
+	c := s.conn
+	for {
+		// Taken before requesting so that no change is missed while the peer has nothing we need
+		picked := t.pieces.Changed()
+		freed := t.sched.Changed()
+		if t.pieces.Complete() {
+			return
+		}
+
+		wait := RequestTimeout
+		if !c.State().PeerChoking {
+			// Setting a deadline helps get unresponsive peers unstuck
+			if oldest := t.sched.oldest(s); !oldest.IsZero() {
+				wait = RequestTimeout - time.Since(oldest)
+				if wait <= 0 {
+					log.Printf("%s did not send the blocks we requested. Disconnecting\n", c.Peer())
+					s.close()
+					return
+				}
+			}
+
+			s.mu.Lock()
+			depth := s.queueDepth()
+			s.mu.Unlock()
+			for _, req := range t.sched.request(s, depth) {
+				err := c.SendRequest(req.index, req.begin, req.length)
+				if err != nil {
+					s.close()
+					return
+				}
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.notify:
+		case <-picked:
+		case <-freed:
+		case <-timer.C:
+		case <-s.closed:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
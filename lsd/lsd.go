@@ -0,0 +1,266 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"torrent/peers"
+)
+
+// DefaultAddrs are the multicast groups of Local Service Discovery (BEP 14)
+var DefaultAddrs = []string{"239.192.152.143:6771", "[ff15::efc0:988f]:6771"}
+
+// Interval is how often active info-hashes are announced on the local network
+var Interval = 5 * time.Minute
+
+// MaxInfoHashes is the number of info-hashes sent in a single announcement
+const MaxInfoHashes = 16
+
+// Config configures Local Service Discovery
+type Config struct {
+	// Addrs are the multicast groups to announce to and listen on, DefaultAddrs when nil
+	Addrs []string
+	// Port is the port peers should connect to
+	Port uint16
+}
+
+type group struct {
+	addr     *net.UDPAddr
+	listener *net.UDPConn
+	sender   *net.UDPConn
+}
+
+// Service announces the torrents we are active in with BT-SEARCH messages and hands the
+// peers announcing the same torrents on the local network to their callbacks
+type Service struct {
+	port   uint16
+	cookie string
+	groups []*group
+
+	mu       sync.Mutex
+	torrents map[[20]byte]func([]peers.Peer)
+	closed   chan struct{}
+}
+
+// Start joins the multicast groups of cfg. Groups that cannot be joined, e.g. IPv6 ones on
+// an IPv4 only host, are skipped
+func Start(cfg Config) (*Service, error) {
+	addrs := cfg.Addrs
+	if addrs == nil {
+		addrs = DefaultAddrs
+	}
+	var cookie [8]byte
+	_, err := rand.Read(cookie[:])
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Service{
+		port:     cfg.Port,
+		cookie:   hex.EncodeToString(cookie[:]),
+		torrents: map[[20]byte]func([]peers.Peer){},
+		closed:   make(chan struct{}),
+	}
+	for _, addr := range addrs {
+		g, err := joinGroup(addr)
+		if err != nil {
+			log.Printf("Could not join LSD group %s: %s\n", addr, err)
+			continue
+		}
+		s.groups = append(s.groups, g)
+		go s.listen(g)
+	}
+	if len(s.groups) == 0 {
+		return nil, fmt.Errorf("could not join any of the %d LSD groups", len(addrs))
+	}
+	go s.run()
+	return s, nil
+}
+
+func joinGroup(addr string) (*group, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if !udpAddr.IP.IsMulticast() {
+		return nil, fmt.Errorf("%s is not a multicast address", addr)
+	}
+	listener, err := net.ListenMulticastUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &group{addr: udpAddr, listener: listener, sender: sender}, nil
+}
+
+// Announce adds an info-hash to the ones we announce and sends an announcement right away.
+// onPeers, which can be nil, receives the peers found for it
+func (s *Service) Announce(infoHash [20]byte, onPeers func([]peers.Peer)) {
+	s.mu.Lock()
+	s.torrents[infoHash] = onPeers
+	s.mu.Unlock()
+	s.send([][20]byte{infoHash})
+}
+
+// Remove stops announcing an info-hash
+func (s *Service) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.torrents, infoHash)
+}
+
+// Close leaves the multicast groups
+func (s *Service) Close() {
+	select {
+	case <-s.closed:
+		return
+	default:
+	}
+	close(s.closed)
+	for _, g := range s.groups {
+		g.listener.Close()
+		g.sender.Close()
+	}
+}
+
+// announces every active info-hash each Interval
+func (s *Service) run() {
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		infoHashes := make([][20]byte, 0, len(s.torrents))
+		for infoHash := range s.torrents {
+			infoHashes = append(infoHashes, infoHash)
+		}
+		s.mu.Unlock()
+
+		for len(infoHashes) > 0 {
+			n := len(infoHashes)
+			if n > MaxInfoHashes {
+				n = MaxInfoHashes
+			}
+			s.send(infoHashes[:n])
+			infoHashes = infoHashes[n:]
+		}
+	}
+}
+
+func (s *Service) send(infoHashes [][20]byte) {
+	for _, g := range s.groups {
+		_, err := g.sender.Write(formatSearch(g.addr.String(), s.port, s.cookie, infoHashes))
+		if err != nil {
+			log.Printf("Could not send LSD announce to %s: %s\n", g.addr, err)
+		}
+	}
+}
+
+func (s *Service) listen(g *group) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := g.listener.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+				continue
+			}
+		}
+
+		search, err := parseSearch(buf[:n])
+		if err != nil || search.cookie == s.cookie {
+			continue
+		}
+		peer := peers.Peer{IP: from.IP, Port: search.port}
+		if ip4 := from.IP.To4(); ip4 != nil {
+			peer.IP = ip4
+		}
+
+		for _, infoHash := range search.infoHashes {
+			s.mu.Lock()
+			onPeers, ok := s.torrents[infoHash]
+			s.mu.Unlock()
+			if ok && onPeers != nil {
+				onPeers([]peers.Peer{peer})
+			}
+		}
+	}
+}
+
+// search is a parsed BT-SEARCH message
+type search struct {
+	port       uint16
+	infoHashes [][20]byte
+	cookie     string
+}
+
+func formatSearch(host string, port uint16, cookie string, infoHashes [][20]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&buf, "Host: %s\r\n", host)
+	fmt.Fprintf(&buf, "Port: %d\r\n", port)
+	for _, infoHash := range infoHashes {
+		fmt.Fprintf(&buf, "Infohash: %x\r\n", infoHash)
+	}
+	fmt.Fprintf(&buf, "cookie: %s\r\n", cookie)
+	buf.WriteString("\r\n\r\n")
+	return buf.Bytes()
+}
+
+func parseSearch(buf []byte) (*search, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "BT-SEARCH * HTTP/1.1" {
+		return nil, fmt.Errorf("not a BT-SEARCH message")
+	}
+
+	s := search{}
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "port":
+			port, err := strconv.ParseUint(value, 10, 16)
+			if err != nil || port == 0 {
+				return nil, fmt.Errorf("invalid port %q", value)
+			}
+			s.port = uint16(port)
+		case "infohash":
+			decoded, err := hex.DecodeString(value)
+			if err != nil || len(decoded) != 20 {
+				continue
+			}
+			var infoHash [20]byte
+			copy(infoHash[:], decoded)
+			s.infoHashes = append(s.infoHashes, infoHash)
+		case "cookie":
+			s.cookie = value
+		}
+	}
+	if s.port == 0 || len(s.infoHashes) == 0 {
+		return nil, fmt.Errorf("BT-SEARCH message without port or info-hash")
+	}
+	return &s, nil
+}
@@ -0,0 +1,59 @@
+package lsd
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"torrent/peers"
+)
+
+func TestSearchRoundTrip(t *testing.T) {
+	infoHashes := [][20]byte{{1}, {2}}
+	buf := formatSearch("239.192.152.143:6771", 6881, "abcd", infoHashes)
+
+	s, err := parseSearch(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.port != 6881 || s.cookie != "abcd" || len(s.infoHashes) != 2 || s.infoHashes[0] != infoHashes[0] || s.infoHashes[1] != infoHashes[1] {
+		t.Errorf("got %+v", s)
+	}
+
+	_, err = parseSearch([]byte("BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\n\r\n\r\n"))
+	if err == nil {
+		t.Errorf("accepted a search without info-hash")
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	// A group of our own keeps other clients on the host out of the test
+	group := []string{fmt.Sprintf("239.192.152.143:%d", 20000+rand.Intn(20000))}
+	first, err := Start(Config{Addrs: group, Port: 6881})
+	if err != nil {
+		t.Skipf("multicast is not available: %s", err)
+	}
+	defer first.Close()
+	second, err := Start(Config{Addrs: group, Port: 6882})
+	if err != nil {
+		t.Skipf("multicast is not available: %s", err)
+	}
+	defer second.Close()
+
+	infoHash := [20]byte{0xbe, 0xef}
+	found := make(chan peers.Peer, 10)
+	first.Announce(infoHash, func(p []peers.Peer) {
+		found <- p[0]
+	})
+	second.Announce(infoHash, nil)
+
+	select {
+	case peer := <-found:
+		if peer.Port != 6882 {
+			t.Errorf("found %s, want the second service on port 6882", peer)
+		}
+	case <-time.After(2 * time.Second):
+		t.Skip("no announcement came back, multicast loopback is probably disabled")
+	}
+}
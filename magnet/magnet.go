@@ -0,0 +1,120 @@
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"torrent/peers"
+)
+
+// Magnet is the content of a magnet:?xt=urn:btih:... link
+type Magnet struct {
+	InfoHash    [20]byte
+	DisplayName string
+	Trackers    []string
+	Peers       []peers.Peer
+	WebSeeds    []string
+}
+
+const btihPrefix = "urn:btih:"
+
+// parses a hex (40 chars) or base32 (32 chars) encoded info-hash
+func parseInfoHash(s string) ([20]byte, error) {
+	var infoHash [20]byte
+	var buf []byte
+	var err error
+	switch len(s) {
+	case 40:
+		buf, err = hex.DecodeString(s)
+	case 32:
+		buf, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return infoHash, fmt.Errorf("info-hash %q has invalid length %d", s, len(s))
+	}
+	if err != nil {
+		return infoHash, fmt.Errorf("malformed info-hash %q: %w", s, err)
+	}
+	copy(infoHash[:], buf)
+	return infoHash, nil
+}
+
+// parses a x.pe value of the form ip:port. Host names are not resolved, parsing a link must
+// not wait on the DNS
+func parsePeer(s string) (peers.Peer, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return peers.Peer{}, fmt.Errorf("malformed peer address %q: %w", s, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return peers.Peer{}, fmt.Errorf("peer address %q is not an IP address", s)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return peers.Peer{}, fmt.Errorf("peer address %q has invalid port", s)
+	}
+	return peers.Peer{IP: ip, Port: uint16(port)}, nil
+}
+
+// Parse parses a magnet URI. Only BitTorrent info-hashes (urn:btih) are supported
+func Parse(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("expected magnet scheme but got %q", u.Scheme)
+	}
+
+	params, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	m := Magnet{}
+	found := false
+	for _, xt := range params["xt"] {
+		if !strings.HasPrefix(strings.ToLower(xt), btihPrefix) {
+			continue
+		}
+		m.InfoHash, err = parseInfoHash(xt[len(btihPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return nil, fmt.Errorf("magnet link has no %s exact topic", btihPrefix)
+	}
+
+	m.DisplayName = params.Get("dn")
+	m.Trackers = params["tr"]
+	m.WebSeeds = params["ws"]
+	// Peers are only hints, a bad one does not make the link unusable
+	for _, pe := range params["x.pe"] {
+		peer, err := parsePeer(pe)
+		if err != nil {
+			log.Printf("Ignoring peer of the magnet link: %s\n", err)
+			continue
+		}
+		m.Peers = append(m.Peers, peer)
+	}
+
+	return &m, nil
+}
+
+// AnnounceList puts every tracker of the magnet link in its own tier so their peers get merged
+func (m *Magnet) AnnounceList() [][]string {
+	announceList := [][]string{}
+	for _, tracker := range m.Trackers {
+		announceList = append(announceList, []string{tracker})
+	}
+	return announceList
+}
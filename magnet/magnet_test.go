@@ -0,0 +1,95 @@
+package magnet
+
+import (
+	"fmt"
+	"testing"
+)
+
+var infoHash = [20]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		uri      string
+		want     Magnet
+		wantPeer []string
+	}{
+		{
+			name: "hex",
+			uri:  "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567",
+			want: Magnet{InfoHash: infoHash},
+		},
+		{
+			name: "base32",
+			uri:  "magnet:?xt=urn:btih:AERUKZ4JVPG66AJDIVTYTK6N54ASGRLH",
+			want: Magnet{InfoHash: infoHash},
+		},
+		{
+			name: "lowercase base32",
+			uri:  "magnet:?xt=urn:btih:aerukz4jvpg66ajdivtytk6n54asgrlh",
+			want: Magnet{InfoHash: infoHash},
+		},
+		{
+			name: "display name and trackers",
+			uri:  "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&dn=debian+12.iso&tr=http%3A%2F%2Fa.example%2Fannounce&tr=udp%3A%2F%2Fb.example%3A6969",
+			want: Magnet{
+				InfoHash:    infoHash,
+				DisplayName: "debian 12.iso",
+				Trackers:    []string{"http://a.example/announce", "udp://b.example:6969"},
+			},
+		},
+		{
+			name:     "peers",
+			uri:      "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&x.pe=10.0.0.1:6881&x.pe=[2001:db8::1]:6882",
+			want:     Magnet{InfoHash: infoHash},
+			wantPeer: []string{"10.0.0.1:6881", "[2001:db8::1]:6882"},
+		},
+		{
+			name:     "bad peers are skipped",
+			uri:      "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&x.pe=peer.invalid:6881&x.pe=10.0.0.1&x.pe=10.0.0.1:0&x.pe=10.0.0.2:6881",
+			want:     Magnet{InfoHash: infoHash},
+			wantPeer: []string{"10.0.0.2:6881"},
+		},
+		{
+			name: "web seeds",
+			uri:  "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&ws=http%3A%2F%2Fseed.example%2Ffile",
+			want: Magnet{InfoHash: infoHash, WebSeeds: []string{"http://seed.example/file"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := Parse(test.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			peers := []string{}
+			for _, peer := range m.Peers {
+				peers = append(peers, peer.String())
+			}
+			m.Peers = nil
+			if fmt.Sprint(*m) != fmt.Sprint(test.want) {
+				t.Errorf("got %+v, want %+v", *m, test.want)
+			}
+			if fmt.Sprint(peers) != fmt.Sprint(test.wantPeer) {
+				t.Errorf("got peers %v, want %v", peers, test.wantPeer)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"http://example.com/?xt=urn:btih:0123456789abcdef0123456789abcdef01234567",
+		"magnet:?dn=no+topic",
+		"magnet:?xt=urn:sha1:0123456789abcdef0123456789abcdef01234567",
+		"magnet:?xt=urn:btih:0123",
+		"magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef0123456z",
+		"magnet:?xt=urn:btih:AERUKZ4JVPG66AJDIVTYTK6N54ASGRL1",
+	}
+	for _, uri := range tests {
+		if _, err := Parse(uri); err == nil {
+			t.Errorf("%s: parsed without error", uri)
+		}
+	}
+}
@@ -1,16 +1,108 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
+	"syscall"
 
+	"torrent/dht"
 	"torrent/leecher"
+	"torrent/lsd"
+	"torrent/magnet"
+	"torrent/metadata"
 	"torrent/seeder"
 	"torrent/torrentfile"
+	"torrent/tracker"
 )
 
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage:")
+	fmt.Fprintln(os.Stderr, "  go run main.go <port> <torrent file or magnet link>")
+	fmt.Fprintln(os.Stderr, "  go run main.go scrape <torrent file or magnet link>")
+	fmt.Fprintln(os.Stderr, "  go run main.go tracker <port> [torrent files to allow...]")
+	os.Exit(2)
+}
+
+// prints the seeders, leechers and completed downloads every tracker reports for a torrent
+func scrape(args []string) {
+	if len(args) != 1 {
+		usage()
+	}
+
+	var torrentFile torrentfile.TorrentFile
+	if strings.HasPrefix(args[0], "magnet:") {
+		link, err := magnet.Parse(args[0])
+		if err != nil {
+			log.Fatal("Magnet link could not be parsed", err)
+		}
+		torrentFile = torrentfile.TorrentFile{AnnounceList: link.AnnounceList(), InfoHash: link.InfoHash}
+	} else {
+		var err error
+		torrentFile, err = torrentfile.ParseFile(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	results, err := torrentFile.Scrape(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	trackers := make([]string, 0, len(results))
+	for tracker := range results {
+		trackers = append(trackers, tracker)
+	}
+	sort.Strings(trackers)
+	for _, tracker := range trackers {
+		result := results[tracker]
+		fmt.Printf("%s\tseeders: %d\tleechers: %d\tcompleted: %d\n", tracker, result.Complete, result.Incomplete, result.Downloaded)
+	}
+}
+
+// runs an HTTP tracker, restricted to the given torrents if any
+func runTracker(args []string) {
+	if len(args) < 1 {
+		usage()
+	}
+	port, err := strconv.Atoi(args[0])
+	if err != nil {
+		log.Fatal("Port Number could not be parsed", err)
+	}
+
+	t := tracker.New()
+	for _, path := range args[1:] {
+		torrentFile, err := torrentfile.ParseFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		t.Allow(torrentFile.InfoHash)
+		log.Printf("Tracking %s (%x)\n", torrentFile.Name, torrentFile.InfoHash)
+	}
+
+	log.Fatal(t.ListenAndServe(fmt.Sprintf(":%d", port)))
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "scrape" {
+		scrape(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "tracker" {
+		runTracker(os.Args[2:])
+		return
+	}
+	if len(os.Args) != 3 {
+		usage()
+	}
+
 	portString := os.Args[1]
 	file := os.Args[2]
 
@@ -19,22 +111,70 @@ func main() {
 		log.Fatal("Port Number could not be parsed", err)
 	}
 
-	torrent, err := torrentfile.Unmarshal(file)
+	// The DHT node shares the port number of the peer listener, over UDP
+	node, err := dht.NewServer(dht.Config{Addr: fmt.Sprintf(":%d", Port)})
+	if err != nil {
+		log.Printf("Could not start the DHT, only using trackers: %s\n", err)
+		node = nil
+	} else {
+		defer node.Close()
+	}
+
+	local, err := lsd.Start(lsd.Config{Port: uint16(Port)})
+	if err != nil {
+		log.Printf("Could not start local peer discovery: %s\n", err)
+		local = nil
+	} else {
+		defer local.Close()
+	}
+
+	var torrent torrentfile.Torrent
+	if strings.HasPrefix(file, "magnet:") {
+		var link *magnet.Magnet
+		link, err = magnet.Parse(file)
+		if err != nil {
+			log.Fatal("Magnet link could not be parsed", err)
+		}
+		torrent, err = metadata.Download(link, uint16(Port), node)
+	} else {
+		torrent, err = torrentfile.Unmarshal(file)
+	}
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
 
-	defer torrent.File.Close()
+	defer torrent.Close()
 
-	leecher, err := leecher.CreateLeecher(torrent, uint16(Port))
+	leecher, err := leecher.CreateLeecher(torrent, uint16(Port), node, local)
 
 	if err != nil {
 		log.Fatal("Leecher could not be Initalized", err)
 		return
 	}
 
-	leecher.Download()
+	// Peers connecting to us are served while we download, and once done we keep seeding
+	go func() {
+		log.Fatal(seeder.Serve(uint16(Port), leecher.Accept))
+	}()
+
+	// SIGINT and SIGTERM make us leave the swarm cleanly, whether downloading or seeding
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	seeder.HandleSeed(&torrent, uint16(Port))
+	err = leecher.Download(ctx)
+	if errors.Is(err, context.Canceled) {
+		log.Printf("Stopped, the pieces downloaded so far are kept\n")
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Seeding %s\n", torrent.Name)
+	<-ctx.Done()
+	log.Printf("Stopped seeding\n")
+	err = leecher.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
 }
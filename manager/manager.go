@@ -0,0 +1,238 @@
+// Package manager keeps the connections with peers within limits. The peers found by the
+// trackers, the DHT, PEX and LSD all go through it, and the ones whose connection failed are
+// dialed again after a backoff
+package manager
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"torrent/peers"
+)
+
+// DefaultMaxConnections is the number of peers we stay connected to, both ways
+const DefaultMaxConnections = 50
+
+// DefaultMaxHalfOpen is the number of connections being dialed at once. Operating systems
+// and routers do not like many connection attempts at the same time
+const DefaultMaxHalfOpen = 8
+
+// MinBackoff is how long we wait before dialing a peer again after the first failure, the
+// wait doubles with each failure up to MaxBackoff
+var MinBackoff = 10 * time.Second
+
+// MaxBackoff caps the wait between two attempts to connect with a peer
+var MaxBackoff = 10 * time.Minute
+
+// MaxFailures is the number of failures in a row after which a peer is forgotten, until a
+// peer source finds it again
+const MaxFailures = 8
+
+// candidate is a peer we can dial
+type candidate struct {
+	peer     peers.Peer
+	failures int
+	next     time.Time // no attempt before then
+	dialing  bool
+}
+
+// Manager decides which peers to connect to. Peers found by any source are queued as
+// candidates and dialed as long as there are free slots, reconnecting with exponential
+// backoff to the peers whose connection failed or broke. Connections both ways are
+// deduplicated by address and peer ID, which also rejects connections to ourselves
+type Manager struct {
+	MaxConnections int
+	MaxHalfOpen    int
+
+	id   [20]byte
+	dial func(peer peers.Peer)
+
+	mu         sync.Mutex
+	candidates map[string]*candidate
+	halfOpen   int
+	connected  map[string]bool     // addresses of the peers we are connected to
+	peerIDs    map[[20]byte]string // peer IDs of the peers we are connected to, by address
+	self       map[string]bool     // addresses that turned out to be ours
+	wake       chan struct{}
+}
+
+// New creates a manager for a client using the peer ID id. dial is called in its own
+// goroutine for each attempt, it reports back through Failed, or Connected and Disconnected
+func New(id [20]byte, dial func(peer peers.Peer)) *Manager {
+	return &Manager{
+		MaxConnections: DefaultMaxConnections,
+		MaxHalfOpen:    DefaultMaxHalfOpen,
+		id:             id,
+		dial:           dial,
+		candidates:     map[string]*candidate{},
+		connected:      map[string]bool{},
+		peerIDs:        map[[20]byte]string{},
+		self:           map[string]bool{},
+		wake:           make(chan struct{}, 1),
+	}
+}
+
+func (m *Manager) signal() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Add queues peers to connect to. Peers already known keep their backoff
+func (m *Manager) Add(found []peers.Peer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, peer := range found {
+		addr := peer.String()
+		if _, ok := m.candidates[addr]; ok || m.self[addr] {
+			continue
+		}
+		m.candidates[addr] = &candidate{peer: peer}
+	}
+	m.signal()
+}
+
+// Run dials the candidates until stop is closed
+func (m *Manager) Run(stop <-chan struct{}) {
+	for {
+		wait := m.dialCandidates()
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-m.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// dials the candidates whose backoff is over while there are free slots, and returns how
+// long to wait before the next one is due
+func (m *Manager) dialCandidates() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	wait := MaxBackoff
+	for addr, c := range m.candidates {
+		if c.dialing || m.connected[addr] {
+			continue
+		}
+		if c.next.After(now) {
+			if c.next.Sub(now) < wait {
+				wait = c.next.Sub(now)
+			}
+			continue
+		}
+		if m.halfOpen >= m.MaxHalfOpen || len(m.connected)+m.halfOpen >= m.MaxConnections {
+			// A slot frees up through Failed, Connected or Disconnected, which wake us
+			break
+		}
+		c.dialing = true
+		m.halfOpen++
+		go m.dial(c.peer)
+	}
+	return wait
+}
+
+// backs off from a candidate, it is forgotten after MaxFailures. m.mu must be held
+func (m *Manager) backoff(addr string) {
+	c, ok := m.candidates[addr]
+	if !ok {
+		return
+	}
+	c.dialing = false
+	c.failures++
+	if c.failures > MaxFailures {
+		delete(m.candidates, addr)
+		return
+	}
+	wait := MinBackoff << (c.failures - 1)
+	if wait > MaxBackoff || wait <= 0 {
+		wait = MaxBackoff
+	}
+	c.next = time.Now().Add(wait)
+}
+
+// Failed reports that dialing a peer failed
+func (m *Manager) Failed(peer peers.Peer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.halfOpen--
+	m.backoff(peer.String())
+	m.signal()
+}
+
+// Connected reports a completed handshake, outgoing tells if we dialed the peer. An error
+// means the connection is not wanted: it is a connection to ourselves, to a peer we are
+// already connected to, or there is no free slot for an incoming connection
+func (m *Manager) Connected(peer peers.Peer, peerID [20]byte, outgoing bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	addr := peer.String()
+	if outgoing {
+		m.halfOpen--
+		defer m.signal()
+	}
+
+	switch {
+	case peerID == m.id:
+		// Trackers and other peers hand us our own address, never dial it again
+		delete(m.candidates, addr)
+		m.self[addr] = true
+		return fmt.Errorf("connected to ourselves")
+	case m.connected[addr]:
+		m.backoff(addr)
+		return fmt.Errorf("already connected to %s", addr)
+	}
+	if other, ok := m.peerIDs[peerID]; ok {
+		if outgoing {
+			m.backoff(addr)
+		}
+		return fmt.Errorf("already connected to peer %x at %s", peerID, other)
+	}
+	if !outgoing && len(m.connected)+m.halfOpen >= m.MaxConnections {
+		return fmt.Errorf("too many connections")
+	}
+
+	m.connected[addr] = true
+	m.peerIDs[peerID] = addr
+	if c, ok := m.candidates[addr]; ok {
+		c.dialing = false
+		c.failures = 0
+	}
+	return nil
+}
+
+// Disconnected reports the end of a connection accepted by Connected. Peers we dialed are
+// dialed again after a backoff
+func (m *Manager) Disconnected(peer peers.Peer, peerID [20]byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	addr := peer.String()
+	delete(m.connected, addr)
+	if m.peerIDs[peerID] == addr {
+		delete(m.peerIDs, peerID)
+	}
+	m.backoff(addr)
+	m.signal()
+}
+
+// Remove forgets a candidate, e.g. a banned peer
+func (m *Manager) Remove(peer peers.Peer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.candidates, peer.String())
+}
+
+// Idle tells if there is no peer left: no connection, no dial in progress and no candidate
+// waiting for its backoff to end
+func (m *Manager) Idle() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.connected) == 0 && m.halfOpen == 0 && len(m.candidates) == 0
+}
@@ -0,0 +1,90 @@
+package manager
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"torrent/peers"
+)
+
+func newTestManager() *Manager {
+	return New([20]byte{0xff}, func(peers.Peer) {})
+}
+
+func TestBackoff(t *testing.T) {
+	m := newTestManager()
+	peer := peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	addr := peer.String()
+	m.Add([]peers.Peer{peer})
+
+	for failures := 1; failures <= MaxFailures; failures++ {
+		m.dialCandidates()
+		if !m.candidates[addr].dialing {
+			t.Fatalf("not dialed after %d failures", failures-1)
+		}
+		start := time.Now()
+		m.Failed(peer)
+
+		// The wait doubles with each failure, up to MaxBackoff
+		want := MinBackoff << (failures - 1)
+		if want > MaxBackoff {
+			want = MaxBackoff
+		}
+		c := m.candidates[addr]
+		if wait := c.next.Sub(start); wait < want || wait > want+time.Second {
+			t.Errorf("waiting %s after %d failures, want %s", wait, failures, want)
+		}
+		if m.dialCandidates(); c.dialing {
+			t.Fatalf("dialed again during the backoff")
+		}
+		c.next = time.Time{} // skip the backoff
+	}
+
+	m.dialCandidates()
+	m.Failed(peer)
+	if _, ok := m.candidates[addr]; ok {
+		t.Errorf("peer still a candidate after %d failures", MaxFailures+1)
+	}
+	if !m.Idle() {
+		t.Errorf("not idle once the only peer is forgotten")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	m := newTestManager()
+	first := peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	second := peers.Peer{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+	id, otherID := [20]byte{1}, [20]byte{2}
+
+	if err := m.Connected(first, id, false); err != nil {
+		t.Fatal(err)
+	}
+	// The same peer at another address, e.g. over IPv4 and IPv6
+	if err := m.Connected(second, id, false); err == nil {
+		t.Errorf("accepted a second connection to peer %x", id)
+	}
+	if err := m.Connected(first, otherID, false); err == nil {
+		t.Errorf("accepted a second connection to %s", first)
+	}
+
+	m.Disconnected(first, id)
+	if err := m.Connected(second, id, false); err != nil {
+		t.Errorf("refused peer %x once its first connection ended: %s", id, err)
+	}
+}
+
+func TestSelf(t *testing.T) {
+	m := newTestManager()
+	self := peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	m.Add([]peers.Peer{self})
+	m.dialCandidates()
+
+	if err := m.Connected(self, m.id, true); err == nil {
+		t.Errorf("accepted a connection to ourselves")
+	}
+	m.Add([]peers.Peer{self})
+	if _, ok := m.candidates[self.String()]; ok {
+		t.Errorf("our own address is a candidate again")
+	}
+}
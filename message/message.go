@@ -9,12 +9,47 @@ import (
 type ID uint8
 
 const (
-	Unchoke  ID = 1
-	Bitfield ID = 5
-	Request  ID = 6
-	Piece    ID = 7
+	Choke         ID = 0
+	Unchoke       ID = 1
+	Interested    ID = 2
+	NotInterested ID = 3
+	Have          ID = 4
+	Bitfield      ID = 5
+	Request       ID = 6
+	Piece         ID = 7
+	Cancel        ID = 8
+	Port          ID = 9
+	Extended      ID = 20
 )
 
+func (id ID) String() string {
+	switch id {
+	case Choke:
+		return "CHOKE"
+	case Unchoke:
+		return "UNCHOKE"
+	case Interested:
+		return "INTERESTED"
+	case NotInterested:
+		return "NOT INTERESTED"
+	case Have:
+		return "HAVE"
+	case Bitfield:
+		return "BITFIELD"
+	case Request:
+		return "REQUEST"
+	case Piece:
+		return "PIECE"
+	case Cancel:
+		return "CANCEL"
+	case Port:
+		return "PORT"
+	case Extended:
+		return "EXTENDED"
+	}
+	return fmt.Sprintf("ID %d", uint8(id))
+}
+
 type Message struct {
 	ID      ID
 	Payload []byte
@@ -29,13 +64,40 @@ func FormatRequest(index, begin, length int) *Message {
 	return &Message{ID: Request, Payload: payload}
 }
 
-func FormatPiece(Payload []byte) *Message {
-	return &Message{ID: Bitfield, Payload: Payload}
+// FormatCancel creates a CANCEL message for a block previously requested
+func FormatCancel(index, begin, length int) *Message {
+	msg := FormatRequest(index, begin, length)
+	msg.ID = Cancel
+	return msg
+}
+
+// FormatPiece creates a PIECE message carrying a block of a piece
+func FormatPiece(index, begin int, data []byte) *Message {
+	payload := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], data)
+	return &Message{ID: Piece, Payload: payload}
 }
 
-func ParseUnchoke(msg *Message) (int, error) {
-	if msg.ID != Unchoke {
-		return 0, fmt.Errorf("Expected HAVE (ID %d), got ID %d", Unchoke, msg.ID)
+// FormatHave creates a HAVE message
+func FormatHave(index int) *Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return &Message{ID: Have, Payload: payload}
+}
+
+// FormatPort creates a PORT message advertising our DHT port
+func FormatPort(port uint16) *Message {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, port)
+	return &Message{ID: Port, Payload: payload}
+}
+
+// ParseHave parses a HAVE message into the index of the piece
+func ParseHave(msg *Message) (int, error) {
+	if msg.ID != Have {
+		return 0, fmt.Errorf("Expected HAVE (ID %d), got ID %d", Have, msg.ID)
 	}
 	if len(msg.Payload) != 4 {
 		return 0, fmt.Errorf("Expected payload length 4, got length %d", len(msg.Payload))
@@ -44,6 +106,50 @@ func ParseUnchoke(msg *Message) (int, error) {
 	return index, nil
 }
 
+// ParseRequest parses a REQUEST or a CANCEL message into the block it refers to
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	if msg.ID != Request && msg.ID != Cancel {
+		return 0, 0, 0, fmt.Errorf("Expected REQUEST or CANCEL, got ID %d", msg.ID)
+	}
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("Expected payload length 12, got length %d", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+// ParsePort parses a PORT message into the peer's DHT port
+func ParsePort(msg *Message) (uint16, error) {
+	if msg.ID != Port {
+		return 0, fmt.Errorf("Expected PORT (ID %d), got ID %d", Port, msg.ID)
+	}
+	if len(msg.Payload) != 2 {
+		return 0, fmt.Errorf("Expected payload length 2, got length %d", len(msg.Payload))
+	}
+	return binary.BigEndian.Uint16(msg.Payload), nil
+}
+
+// FormatExtended creates an extension protocol (BEP 10) message. id 0 is the extended handshake
+func FormatExtended(id uint8, payload []byte) *Message {
+	buf := make([]byte, len(payload)+1)
+	buf[0] = id
+	copy(buf[1:], payload)
+	return &Message{ID: Extended, Payload: buf}
+}
+
+// ParseExtended parses an extension protocol message into its extended ID and payload
+func ParseExtended(msg *Message) (uint8, []byte, error) {
+	if msg.ID != Extended {
+		return 0, nil, fmt.Errorf("Expected EXTENDED (ID %d), got ID %d", Extended, msg.ID)
+	}
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("Payload too short. %d < 1", len(msg.Payload))
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
 // ParsePiece parses a PIECE message and copies its payload into a buffer
 func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	if msg.ID != Piece {
@@ -0,0 +1,242 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"time"
+
+	"torrent/connection"
+	"torrent/dht"
+	"torrent/magnet"
+	"torrent/message"
+	"torrent/peers"
+	"torrent/torrentfile"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// BlockSize is the size of a single metadata piece (BEP 9)
+const BlockSize = 16384
+
+// MaxSize is the largest info dictionary we are willing to download
+const MaxSize = 16 * 1024 * 1024
+
+// MaxFetchers is the number of peers asked for the metadata at the same time
+const MaxFetchers = 20
+
+// unknownLeft is what we tell the trackers we have left to download while we don't know the
+// size of the torrent. Announcing 0 would make us a seed, which gets no seeds in return
+const unknownLeft = BlockSize
+
+const (
+	msgRequest = 0
+	msgData    = 1
+	msgReject  = 2
+)
+
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// metadataProgress is the ut_metadata extension of a single connection
+type metadataProgress struct {
+	buf       []byte
+	received  []bool
+	remaining int
+}
+
+// Handshake requests every piece of the metadata once the peer told us its size
+func (state *metadataProgress) Handshake(c *connection.Connection) error {
+	if !c.SupportsExtension("ut_metadata") {
+		return fmt.Errorf("peer does not support ut_metadata")
+	}
+	size, ok := c.HandshakeInt("metadata_size")
+	if !ok || size <= 0 || size > MaxSize {
+		return fmt.Errorf("peer advertised invalid metadata size %d", size)
+	}
+
+	state.buf = make([]byte, size)
+	state.remaining = (size + BlockSize - 1) / BlockSize
+	state.received = make([]bool, state.remaining)
+
+	for piece := range state.received {
+		var req bytes.Buffer
+		err := bencode.Marshal(&req, metadataMessage{MsgType: msgRequest, Piece: piece})
+		if err != nil {
+			return err
+		}
+		err = c.SendExtension("ut_metadata", req.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handle stores a piece of the metadata sent by the peer
+func (state *metadataProgress) Handle(c *connection.Connection, payload []byte) error {
+	if state.buf == nil {
+		return fmt.Errorf("received metadata before the extended handshake")
+	}
+
+	// The bencoded dictionary is followed by the raw piece data
+	reader := bytes.NewReader(payload)
+	buffered := bufio.NewReader(reader)
+	msg := metadataMessage{}
+	err := bencode.Unmarshal(buffered, &msg)
+	if err != nil {
+		return err
+	}
+	data := payload[len(payload)-buffered.Buffered()-reader.Len():]
+
+	switch msg.MsgType {
+	case msgReject:
+		return fmt.Errorf("peer rejected metadata piece %d", msg.Piece)
+	case msgData:
+		if msg.Piece < 0 || msg.Piece >= len(state.received) {
+			return fmt.Errorf("metadata piece %d out of range", msg.Piece)
+		}
+		begin := msg.Piece * BlockSize
+		end := begin + BlockSize
+		if end > len(state.buf) {
+			end = len(state.buf)
+		}
+		if len(data) != end-begin {
+			return fmt.Errorf("metadata piece %d has length %d, expected %d", msg.Piece, len(data), end-begin)
+		}
+		if !state.received[msg.Piece] {
+			copy(state.buf[begin:end], data)
+			state.received[msg.Piece] = true
+			state.remaining--
+		}
+	}
+	return nil
+}
+
+func readMessage(c *connection.Connection) error {
+	msg, err := c.Read() // this call blocks
+	if err != nil {
+		return err
+	}
+	if msg == nil || msg.ID != message.Extended {
+		return nil
+	}
+	return c.HandleExtended(msg)
+}
+
+// downloads the info dictionary from a single peer
+func fetchFrom(peer peers.Peer, peerID, infoHash [20]byte) ([]byte, error) {
+	c, err := connection.NewExtended(peer, peerID, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Conn.Close()
+
+	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	state := &metadataProgress{}
+	c.Extensions = connection.NewExtensions()
+	c.Extensions.Register("ut_metadata", state)
+	err = c.SendExtendedHandshake()
+	if err != nil {
+		return nil, err
+	}
+
+	for state.buf == nil || state.remaining > 0 {
+		err := readMessage(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hash := sha1.Sum(state.buf)
+	if !bytes.Equal(hash[:], infoHash[:]) {
+		return nil, fmt.Errorf("metadata from %s does not match info-hash %x", peer, infoHash)
+	}
+	return state.buf, nil
+}
+
+// Fetch downloads the info dictionary of infoHash from the first peer able to provide it
+func Fetch(candidates []peers.Peer, peerID, infoHash [20]byte) ([]byte, error) {
+	results := make(chan []byte, len(candidates))
+	slots := make(chan struct{}, MaxFetchers)
+	for _, peer := range candidates {
+		go func(peer peers.Peer) {
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			rawInfo, err := fetchFrom(peer, peerID, infoHash)
+			if err != nil {
+				log.Printf("Could not fetch metadata from %s: %s\n", peer, err)
+			}
+			results <- rawInfo
+		}(peer)
+	}
+
+	for range candidates {
+		if rawInfo := <-results; rawInfo != nil {
+			return rawInfo, nil
+		}
+	}
+	return nil, fmt.Errorf("none of the %d peers could provide the metadata", len(candidates))
+}
+
+// Download finds peers for a magnet link, fetches the info dictionary from them and
+// turns it into a Torrent ready to be leeched. Peers come from the trackers, the link itself
+// and the DHT when node is not nil
+func Download(m *magnet.Magnet, port uint16, node *dht.Server) (torrentfile.Torrent, error) {
+	var peerID [20]byte
+	_, err := rand.Read(peerID[:])
+	if err != nil {
+		return torrentfile.Torrent{}, err
+	}
+
+	announceList := m.AnnounceList()
+
+	candidates := append([]peers.Peer{}, m.Peers...)
+	if len(announceList) > 0 {
+		t := torrentfile.Torrent{AnnounceList: announceList, InfoHash: m.InfoHash}
+		req := torrentfile.AnnounceRequest{PeerID: peerID, Port: port, Left: unknownLeft, Event: torrentfile.EventStarted}
+		resp, err := t.SendAnnounce(context.Background(), req)
+		if err != nil {
+			log.Printf("Could not get peers from the trackers: %s\n", err)
+		} else {
+			candidates = append(candidates, resp.Peers...)
+			// The leecher announces again with its own peer ID once we have the metadata
+			defer func() {
+				req.Event = torrentfile.EventStopped
+				if _, err := t.SendAnnounce(context.Background(), req); err != nil {
+					log.Printf("Could not announce stop: %s\n", err)
+				}
+			}()
+		}
+	}
+	if node != nil {
+		found, err := node.GetPeers(m.InfoHash)
+		if err != nil {
+			log.Printf("Could not get peers from the DHT: %s\n", err)
+		}
+		candidates = append(candidates, found...)
+	}
+	if len(candidates) == 0 {
+		return torrentfile.Torrent{}, fmt.Errorf("no peers found for %x", m.InfoHash)
+	}
+
+	rawInfo, err := Fetch(candidates, peerID, m.InfoHash)
+	if err != nil {
+		return torrentfile.Torrent{}, err
+	}
+
+	torrentFile, err := torrentfile.ParseInfo(rawInfo, announceList)
+	if err != nil {
+		return torrentfile.Torrent{}, err
+	}
+	return torrentFile.ParseTorrent()
+}
@@ -0,0 +1,151 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"net"
+	"strings"
+	"testing"
+
+	"torrent/handshake"
+	"torrent/message"
+	"torrent/peers"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// serves info over ut_metadata on loopback. The pieces are sent once every one of them was
+// requested, last piece first
+func serveMetadata(t *testing.T, info []byte) peers.Peer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, info)
+		}
+	}()
+
+	peer, err := peers.Parse(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return peer
+}
+
+func serveConn(conn net.Conn, info []byte) {
+	defer conn.Close()
+	req, err := handshake.Read(conn)
+	if err != nil {
+		return
+	}
+	res := handshake.New(req.InfoHash, [20]byte{1})
+	res.SetExtensionProtocol()
+	conn.Write(res.Serialize())
+
+	const ourID = 3
+	var hs bytes.Buffer
+	bencode.Marshal(&hs, map[string]interface{}{
+		"m":             map[string]interface{}{"ut_metadata": ourID},
+		"metadata_size": len(info),
+	})
+	conn.Write(message.FormatExtended(0, hs.Bytes()).Serialize())
+
+	numPieces := (len(info) + BlockSize - 1) / BlockSize
+	var theirID uint8
+	requested := []int{}
+	for len(requested) < numPieces {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil || msg.ID != message.Extended {
+			continue
+		}
+		id, payload, err := message.ParseExtended(msg)
+		if err != nil {
+			return
+		}
+		switch id {
+		case 0:
+			theirHS := struct {
+				M map[string]int `bencode:"m"`
+			}{}
+			bencode.Unmarshal(bytes.NewReader(payload), &theirHS)
+			theirID = uint8(theirHS.M["ut_metadata"])
+		case ourID:
+			m := metadataMessage{}
+			bencode.Unmarshal(bytes.NewReader(payload), &m)
+			requested = append(requested, m.Piece)
+		}
+	}
+
+	for i := len(requested) - 1; i >= 0; i-- {
+		piece := requested[i]
+		begin, end := piece*BlockSize, (piece+1)*BlockSize
+		if end > len(info) {
+			end = len(info)
+		}
+		var data bytes.Buffer
+		bencode.Marshal(&data, metadataMessage{MsgType: msgData, Piece: piece, TotalSize: len(info)})
+		data.Write(info[begin:end])
+		conn.Write(message.FormatExtended(theirID, data.Bytes()).Serialize())
+	}
+
+	// Wait for the other side to hang up
+	message.Read(conn)
+}
+
+// returns an info dictionary spanning three metadata pieces
+func testInfo() []byte {
+	var info bytes.Buffer
+	bencode.Marshal(&info, map[string]interface{}{
+		"name":         "test",
+		"length":       1 << 20,
+		"piece length": 1 << 18,
+		"pieces":       strings.Repeat("0123456789abcdefghij", 2000),
+	})
+	return info.Bytes()
+}
+
+func TestFetchAssemblesPieces(t *testing.T) {
+	info := testInfo()
+	if len(info) <= 2*BlockSize {
+		t.Fatalf("info is only %d bytes", len(info))
+	}
+	peer := serveMetadata(t, info)
+
+	got, err := fetchFrom(peer, [20]byte{2}, sha1.Sum(info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, info) {
+		t.Errorf("assembled metadata differs from the info dictionary")
+	}
+}
+
+func TestFetchRejectsWrongHash(t *testing.T) {
+	info := testInfo()
+	bad := serveMetadata(t, append([]byte{}, info[:len(info)-1]...))
+	good := serveMetadata(t, info)
+	infoHash := sha1.Sum(info)
+
+	_, err := fetchFrom(bad, [20]byte{2}, infoHash)
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("got %v, want the metadata to be rejected", err)
+	}
+
+	got, err := Fetch([]peers.Peer{bad, good}, [20]byte{2}, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, info) {
+		t.Errorf("fetched metadata differs from the info dictionary")
+	}
+}
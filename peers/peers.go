@@ -17,25 +17,16 @@ type Peer struct {
 func Unmarshal(peersBin []byte) ([]Peer, error) {
 	const peerSize = 6 // 4 for IP, 2 for port
 	numPeers := len(peersBin) / peerSize
-	// numPeers := 1
 	if len(peersBin)%peerSize != 0 {
 		err := fmt.Errorf("received malformed peers")
 		return nil, err
 	}
-	peer := make([]byte, 4)
-	// 10.6.250.226
-	peer[0] = 127
-	peer[1] = 0
-	peer[2] = 0
-	peer[3] = 1
 
 	peers := make([]Peer, numPeers)
 	for i := 0; i < numPeers; i++ {
 		offset := i * peerSize
 		peers[i].IP = net.IP(peersBin[offset : offset+4])
 		peers[i].Port = binary.BigEndian.Uint16([]byte(peersBin[offset+4 : offset+6]))
-		// peers[i].IP = net.IP(peer)
-		// peers[i].Port = 8080
 	}
 
 	return peers, nil
@@ -44,3 +35,69 @@ func Unmarshal(peersBin []byte) ([]Peer, error) {
 func (p Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
+
+// Unmarshal6 parses compact IPv6 peer addresses and ports (peers6) from a buffer
+func Unmarshal6(peersBin []byte) ([]Peer, error) {
+	const peerSize = 18 // 16 for IP, 2 for port
+	if len(peersBin)%peerSize != 0 {
+		err := fmt.Errorf("received malformed peers6")
+		return nil, err
+	}
+	numPeers := len(peersBin) / peerSize
+
+	peers := make([]Peer, numPeers)
+	for i := 0; i < numPeers; i++ {
+		offset := i * peerSize
+		peers[i].IP = net.IP(append([]byte{}, peersBin[offset:offset+16]...))
+		peers[i].Port = binary.BigEndian.Uint16(peersBin[offset+16 : offset+18])
+	}
+
+	return peers, nil
+}
+
+// Parse parses an address of the form ip:port or [ipv6]:port, the inverse of String
+func Parse(addr string) (Peer, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Peer{}, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return Peer{}, fmt.Errorf("invalid peer IP %q", host)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return Peer{}, fmt.Errorf("invalid peer port %q", portString)
+	}
+	return Peer{IP: ip, Port: uint16(port)}, nil
+}
+
+// Marshal encodes the IPv4 peers in the compact format read by Unmarshal, other peers are skipped
+func Marshal(found []Peer) []byte {
+	buf := make([]byte, 0, 6*len(found))
+	for _, peer := range found {
+		ip := peer.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, peer.Port)
+	}
+	return buf
+}
+
+// Marshal6 encodes the IPv6 peers in the compact format read by Unmarshal6, IPv4 peers are skipped
+func Marshal6(found []Peer) []byte {
+	buf := make([]byte, 0, 18*len(found))
+	for _, peer := range found {
+		if peer.IP.To4() != nil || len(peer.IP) != net.IPv6len {
+			continue
+		}
+		buf = append(buf, peer.IP...)
+		buf = binary.BigEndian.AppendUint16(buf, peer.Port)
+	}
+	return buf
+}
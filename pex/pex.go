@@ -0,0 +1,249 @@
+package pex
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"torrent/connection"
+	"torrent/peers"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Name is the name of the extension in the extended handshake
+const Name = "ut_pex"
+
+// Flags describing a peer in added.f and added6.f (BEP 11)
+const (
+	FlagEncryption = 0x01 // prefers encrypted connections
+	FlagSeed       = 0x02 // is a seed or upload only
+	FlagUTP        = 0x04 // supports uTP
+	FlagHolepunch  = 0x08 // supports ut_holepunch
+	FlagReachable  = 0x10 // we reached it with an outgoing connection
+)
+
+// Interval is how often the connected peers are told about the changes of our peer list
+var Interval = time.Minute
+
+// MinInterval is how long a peer has to wait between two messages. Messages arriving
+// sooner are ignored so a peer cannot flood us with addresses
+var MinInterval = 45 * time.Second
+
+// MaxPeers is the largest number of added and of dropped peers in a single message
+const MaxPeers = 50
+
+// message is the payload of a ut_pex message, every field holds compact peers or flags
+type message struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Added6   string `bencode:"added6"`
+	Added6F  string `bencode:"added6.f"`
+	Dropped  string `bencode:"dropped"`
+	Dropped6 string `bencode:"dropped6"`
+}
+
+// what we know about a connection running ut_pex
+type connState struct {
+	sent     map[string]bool // the peers the connection was last told about
+	received time.Time       // when its last message was accepted
+	stop     chan struct{}
+}
+
+// Swarm is the ut_pex extension. It keeps the list of peers we are connected to, sends the
+// changes to every connection supporting ut_pex and hands the peers it learns about to OnPeers
+type Swarm struct {
+	OnPeers func([]peers.Peer)
+
+	numPieces int
+	mu        sync.Mutex
+	connected map[string]*connection.Connection
+	flags     map[string]byte
+	conns     map[*connection.Connection]*connState
+}
+
+// New creates the extension for a torrent of numPieces pieces, register it with
+// Extensions.Register(pex.Name, swarm)
+func New(numPieces int, onPeers func([]peers.Peer)) *Swarm {
+	return &Swarm{
+		OnPeers:   onPeers,
+		numPieces: numPieces,
+		connected: map[string]*connection.Connection{},
+		flags:     map[string]byte{},
+		conns:     map[*connection.Connection]*connState{},
+	}
+}
+
+// Add records that we are connected to a peer. flags are sent to other peers about it along
+// with the ones its connection tells, see peerFlags
+func (s *Swarm) Add(c *connection.Connection, flags byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addr := c.Peer().String()
+	s.connected[addr] = c
+	s.flags[addr] = flags
+}
+
+// returns the flags a connection tells about its peer. Its bitfield and extended handshake
+// arrive after Add, so they are looked at when the peer is first sent to another one
+func (s *Swarm) peerFlags(c *connection.Connection) byte {
+	flags := s.flags[c.Peer().String()]
+	if uploadOnly, _ := c.HandshakeInt("upload_only"); uploadOnly != 0 || c.PeerComplete(s.numPieces) {
+		flags |= FlagSeed
+	}
+	if encryption, _ := c.HandshakeInt("e"); encryption != 0 {
+		flags |= FlagEncryption
+	}
+	return flags
+}
+
+// Drop records that we are no longer connected to a peer and stops exchanging peers over
+// its connection
+func (s *Swarm) Drop(c *connection.Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addr := c.Peer().String()
+	delete(s.connected, addr)
+	delete(s.flags, addr)
+	if state, ok := s.conns[c]; ok {
+		close(state.stop)
+		delete(s.conns, c)
+	}
+}
+
+// Handshake starts sending our peer list once the peer told us it supports ut_pex
+func (s *Swarm) Handshake(c *connection.Connection) error {
+	if !c.SupportsExtension(Name) {
+		return nil
+	}
+	s.mu.Lock()
+	if _, ok := s.conns[c]; ok {
+		s.mu.Unlock()
+		return nil
+	}
+	state := &connState{sent: map[string]bool{}, stop: make(chan struct{})}
+	s.conns[c] = state
+	s.mu.Unlock()
+
+	go s.run(c, state)
+	return nil
+}
+
+// sends the changes of our peer list every Interval until the connection is dropped
+func (s *Swarm) run(c *connection.Connection, state *connState) {
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+	for {
+		payload, ok, err := s.diff(c, state)
+		if err == nil && ok {
+			err = c.SendExtension(Name, payload)
+		}
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-state.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// builds the message telling a connection which peers were added and dropped since the
+// last one. ok is false when nothing changed
+func (s *Swarm) diff(c *connection.Connection, state *connState) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	self := c.Peer().String()
+
+	added, dropped := []peers.Peer{}, []peers.Peer{}
+	var flags4, flags6 []byte
+	for addr, conn := range s.connected {
+		if addr == self || state.sent[addr] || len(added) == MaxPeers {
+			continue
+		}
+		state.sent[addr] = true
+		peer := conn.Peer()
+		added = append(added, peer)
+		if peer.IP.To4() != nil {
+			flags4 = append(flags4, s.peerFlags(conn))
+		} else {
+			flags6 = append(flags6, s.peerFlags(conn))
+		}
+	}
+	for addr := range state.sent {
+		if _, ok := s.connected[addr]; ok || len(dropped) == MaxPeers {
+			continue
+		}
+		delete(state.sent, addr)
+		peer, err := peers.Parse(addr)
+		if err == nil {
+			dropped = append(dropped, peer)
+		}
+	}
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil, false, nil
+	}
+
+	msg := message{
+		Added:    string(peers.Marshal(added)),
+		AddedF:   string(flags4),
+		Added6:   string(peers.Marshal6(added)),
+		Added6F:  string(flags6),
+		Dropped:  string(peers.Marshal(dropped)),
+		Dropped6: string(peers.Marshal6(dropped)),
+	}
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, msg)
+	return buf.Bytes(), true, err
+}
+
+// Handle passes the peers a connection tells us about to OnPeers. Messages from peers that
+// did not advertise ut_pex in their extended handshake are ignored
+func (s *Swarm) Handle(c *connection.Connection, payload []byte) error {
+	s.mu.Lock()
+	state, ok := s.conns[c]
+	if !ok || !state.received.IsZero() && time.Since(state.received) < MinInterval {
+		s.mu.Unlock()
+		return nil
+	}
+	state.received = time.Now()
+	s.mu.Unlock()
+
+	msg := message{}
+	err := bencode.Unmarshal(bytes.NewReader(payload), &msg)
+	if err != nil {
+		return err
+	}
+
+	found, err := peers.Unmarshal([]byte(msg.Added))
+	if err != nil {
+		return err
+	}
+	found6, err := peers.Unmarshal6([]byte(msg.Added6))
+	if err != nil {
+		return err
+	}
+	found = append(found, found6...)
+	if len(found) > 2*MaxPeers {
+		found = found[:2*MaxPeers]
+	}
+
+	s.mu.Lock()
+	fresh := []peers.Peer{}
+	for _, peer := range found {
+		if peer.Port == 0 {
+			continue
+		}
+		if _, ok := s.connected[peer.String()]; !ok {
+			fresh = append(fresh, peer)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(fresh) > 0 && s.OnPeers != nil {
+		s.OnPeers(fresh)
+	}
+	return nil
+}
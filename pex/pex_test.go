@@ -0,0 +1,106 @@
+package pex
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"torrent/bitfield"
+	"torrent/connection"
+	"torrent/handshake"
+	wire "torrent/message"
+	"torrent/peers"
+
+	"github.com/jackpal/bencode-go"
+)
+
+var infoHash = [20]byte{0xab}
+
+// connects to a fake peer on loopback that sends bf and the extended handshake hs, and
+// returns our connection once both are read
+func connect(t *testing.T, bf bitfield.Bitfield, hs map[string]interface{}) *connection.Connection {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		if _, err := handshake.Read(conn); err != nil {
+			return
+		}
+		res := handshake.New(infoHash, [20]byte{1})
+		res.SetExtensionProtocol()
+		var payload bytes.Buffer
+		bencode.Marshal(&payload, hs)
+		conn.Write(res.Serialize())
+		conn.Write((&wire.Message{ID: wire.Bitfield, Payload: bf}).Serialize())
+		conn.Write(wire.FormatExtended(connection.HandshakeID, payload.Bytes()).Serialize())
+	}()
+
+	peer, err := peers.Parse(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := connection.Dial(peer, [20]byte{2}, infoHash, bitfield.Bitfield{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Conn.Close() })
+	for i := 0; i < 2; i++ {
+		msg, err := c.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.ID == wire.Extended {
+			if err := c.HandleExtended(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return c
+}
+
+func TestAddedFlags(t *testing.T) {
+	mPEX := map[string]interface{}{Name: 1}
+	seed := connect(t, bitfield.Bitfield{0xf0}, map[string]interface{}{"m": mPEX})
+	leech := connect(t, bitfield.Bitfield{0xe0}, map[string]interface{}{"m": mPEX, "e": 1})
+	uploadOnly := connect(t, bitfield.Bitfield{0x00}, map[string]interface{}{"m": mPEX, "upload_only": 1})
+	receiver := connect(t, bitfield.Bitfield{0x00}, map[string]interface{}{"m": mPEX})
+
+	s := New(4, nil)
+	for _, c := range []*connection.Connection{seed, leech, uploadOnly, receiver} {
+		s.Add(c, FlagReachable)
+	}
+	payload, ok, err := s.diff(receiver, &connState{sent: map[string]bool{}})
+	if err != nil || !ok {
+		t.Fatalf("got ok %t, error %v", ok, err)
+	}
+
+	msg := message{}
+	if err := bencode.Unmarshal(bytes.NewReader(payload), &msg); err != nil {
+		t.Fatal(err)
+	}
+	added, err := peers.Unmarshal([]byte(msg.Added))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 3 || len(msg.AddedF) != 3 {
+		t.Fatalf("got %d peers and %d flags, want 3 of each", len(added), len(msg.AddedF))
+	}
+	want := map[string]byte{
+		seed.Peer().String():       FlagReachable | FlagSeed,
+		leech.Peer().String():      FlagReachable | FlagEncryption,
+		uploadOnly.Peer().String(): FlagReachable | FlagSeed,
+	}
+	for i, peer := range added {
+		if flags, ok := want[peer.String()]; !ok || msg.AddedF[i] != flags {
+			t.Errorf("%s: got flags %#x, want %#x", peer, msg.AddedF[i], flags)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Package picker chooses the pieces to download: the rarest among the connected peers, after
+// a few random ones that give us something to share quickly
+package picker
+
+import (
+	"math/rand"
+	"sync"
+
+	"torrent/bitfield"
+)
+
+// RandomFirstPieces is the number of pieces picked at random before switching to rarest
+// first. Any piece gets us something to upload quickly, the rarest one may be slow to get
+var RandomFirstPieces = 4
+
+// Picker chooses which piece to download from a peer. It counts how many connected peers
+// have each piece and hands out the rarest piece the peer has, ties are broken at random.
+// Once every missing piece is pending the picker is in endgame mode
+type Picker struct {
+	mu           sync.Mutex
+	numPieces    int
+	availability []int
+	have         bitfield.Bitfield
+	pending      map[int]bool // pieces being downloaded
+	completed    int
+	peers        map[interface{}]bitfield.Bitfield
+	changed      chan struct{}
+}
+
+// New creates a picker for a torrent of numPieces pieces. have tells the pieces we already
+// have, it can be nil
+func New(numPieces int, have func(index int) bool) *Picker {
+	p := &Picker{
+		numPieces:    numPieces,
+		availability: make([]int, numPieces),
+		have:         make(bitfield.Bitfield, (numPieces+7)/8),
+		pending:      map[int]bool{},
+		peers:        map[interface{}]bitfield.Bitfield{},
+		changed:      make(chan struct{}),
+	}
+	for index := 0; index < numPieces && have != nil; index++ {
+		if have(index) {
+			p.have.SetPiece(index)
+			p.completed++
+		}
+	}
+	return p
+}
+
+// SetBitfield records the pieces a peer has, replacing what was known about it. peer is
+// anything identifying the peer, like its connection
+func (p *Picker) SetBitfield(peer interface{}, bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := p.peers[peer]
+	known := make(bitfield.Bitfield, len(p.have))
+	for index := 0; index < p.numPieces; index++ {
+		had := old.HasPiece(index)
+		has := bf.HasPiece(index)
+		if has {
+			known.SetPiece(index)
+		}
+		if has && !had {
+			p.availability[index]++
+		} else if had && !has {
+			p.availability[index]--
+		}
+	}
+	p.peers[peer] = known
+	p.notify()
+}
+
+// Have records that a peer got a piece
+func (p *Picker) Have(peer interface{}, index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index < 0 || index >= p.numPieces {
+		return
+	}
+	known, ok := p.peers[peer]
+	if !ok {
+		known = make(bitfield.Bitfield, len(p.have))
+		p.peers[peer] = known
+	}
+	if known.HasPiece(index) {
+		return
+	}
+	known.SetPiece(index)
+	p.availability[index]++
+	p.notify()
+}
+
+// RemovePeer forgets the pieces of a peer that disconnected
+func (p *Picker) RemovePeer(peer interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	known, ok := p.peers[peer]
+	if !ok {
+		return
+	}
+	for index := 0; index < p.numPieces; index++ {
+		if known.HasPiece(index) {
+			p.availability[index]--
+		}
+	}
+	delete(p.peers, peer)
+}
+
+// Pick returns the piece to download next from a peer, among the pieces has tells it has,
+// and marks it as pending. ok is false when the peer has nothing we still need
+func (p *Picker) Pick(has func(index int) bool) (index int, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	random := p.completed < RandomFirstPieces
+	rarest := -1
+	ties := 0
+	for i := 0; i < p.numPieces; i++ {
+		if p.have.HasPiece(i) || p.pending[i] || !has(i) {
+			continue
+		}
+		switch {
+		case random || p.availability[i] == rarest:
+			// Reservoir sampling keeps each candidate with the same probability
+			ties++
+			if rand.Intn(ties) == 0 {
+				index = i
+			}
+		case rarest == -1 || p.availability[i] < rarest:
+			rarest = p.availability[i]
+			ties = 1
+			index = i
+		}
+	}
+	if ties == 0 {
+		return 0, false
+	}
+	p.pending[index] = true
+	if p.endgame() {
+		// Peers with nothing left to pick can now help with the pending pieces
+		p.notify()
+	}
+	return index, true
+}
+
+// tells if every missing piece is pending
+func (p *Picker) endgame() bool {
+	return len(p.pending) > 0 && p.completed+len(p.pending) == p.numPieces
+}
+
+// Endgame tells if the picker is in endgame mode
+func (p *Picker) Endgame() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.endgame()
+}
+
+// Done marks a piece as downloaded and verified
+func (p *Picker) Done(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pending, index)
+	if index < 0 || index >= p.numPieces || p.have.HasPiece(index) {
+		return
+	}
+	p.have.SetPiece(index)
+	p.completed++
+	p.notify()
+}
+
+// Complete tells if every piece was downloaded
+func (p *Picker) Complete() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.completed == p.numPieces
+}
+
+// Changed returns a channel closed the next time a piece becomes available again, a peer
+// gets new pieces or a piece is done. Peers that had nothing to pick wait on it
+func (p *Picker) Changed() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.changed
+}
+
+func (p *Picker) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
@@ -1,14 +1,12 @@
 package seeder
 
 import (
-	"bufio"
-	"encoding/binary"
+	"bytes"
 	"fmt"
 	"log"
 	"net"
-	"os"
+	"sync"
 	"torrent/connection"
-	"torrent/handshake"
 	"torrent/message"
 	"torrent/torrentfile"
 )
@@ -23,22 +21,25 @@ type Request struct {
 
 // Some Remaining shit todo here
 func parseRequest(torrent *torrentfile.Torrent, msg *message.Message) (*Request, error) {
-	if msg.ID != message.Request {
-		return nil, fmt.Errorf("Expected REQUEST (ID %d), got ID %d", message.Request, msg.ID)
+	index, blockStart, blockSize, err := message.ParseRequest(msg)
+	if err != nil {
+		return nil, err
 	}
-
-	if len(msg.Payload) < 12 {
-		return nil, fmt.Errorf("Payload too short. %d < 8", len(msg.Payload))
+	if index >= len(torrent.PieceHashes) {
+		return nil, fmt.Errorf("piece index %d out of range", index)
 	}
-	MaxBound := torrent.PieceLength * len(torrent.PieceHashes)
-	index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
-	blockStart := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
-	blockSize := int(binary.BigEndian.Uint32(msg.Payload[8:12]))
-	begin := index*torrent.PieceLength + blockStart
+	if !torrent.HasPiece(index) {
+		return nil, fmt.Errorf("piece %d is not downloaded yet", index)
+	}
+	pieceBegin, pieceEnd := torrent.PieceBound(index)
+	begin := pieceBegin + blockStart
 	end := begin + blockSize
 
-	if end > MaxBound {
-		end = MaxBound
+	if begin >= pieceEnd {
+		return nil, fmt.Errorf("block offset %d out of range for piece %d", blockStart, index)
+	}
+	if end > pieceEnd {
+		end = pieceEnd
 		blockSize = end - begin
 	}
 	request := Request{
@@ -53,84 +54,130 @@ func parseRequest(torrent *torrentfile.Torrent, msg *message.Message) (*Request,
 }
 
 func CreatePieceMessage(request *Request, data []byte) *message.Message {
-	payload := make([]byte, 8+len(data))
-	binary.BigEndian.PutUint32(payload[0:4], uint32(request.Index))
-	binary.BigEndian.PutUint32(payload[4:8], uint32(request.BlockBegin))
-	for idx := 0; idx < len(data); idx++ {
-		payload[8+idx] = data[idx]
-	}
-	return &message.Message{ID: message.Piece, Payload: payload}
+	return message.FormatPiece(request.Index, request.BlockBegin, data)
 }
 
-func Upload(torrent *torrentfile.Torrent, msg *message.Message, conn net.Conn) error {
+func Upload(torrent *torrentfile.Torrent, msg *message.Message, c *connection.Connection) error {
 	request, err := parseRequest(torrent, msg)
 	if err != nil {
 		return err
 	}
-	file, err := os.Open(torrent.Name)
-	defer file.Close()
-	if err != nil {
-		return fmt.Errorf("could not read file due to unexpected error", err)
-	}
 	data := make([]byte, request.BlockSize)
-	_, err = file.ReadAt(data, int64(request.Begin))
+	_, err = torrent.ReadAt(data, int64(request.Begin))
 
 	if err != nil {
-		return fmt.Errorf("uploading Interrupted due to unexpected error", err)
+		return fmt.Errorf("uploading Interrupted due to unexpected error: %w", err)
 	}
 
-	message := CreatePieceMessage(request, data)
-
-	conn.Write(message.Serialize())
+	err = c.Send(CreatePieceMessage(request, data))
+	if err != nil {
+		return err
+	}
+	torrent.Stats.AddUploaded(len(data))
 
 	// conn.Write()
 	return nil
 }
 
-func handleConnection(torrent *torrentfile.Torrent, conn net.Conn) {
-	defer conn.Close()
-	reader := bufio.NewReader(conn)
-	res, err := handshake.Read(reader)
+// MaxQueuedRequests is the number of requests a leecher can have waiting to be served,
+// requests beyond it are dropped
+const MaxQueuedRequests = 250
 
-	if err != nil {
+// RequestQueue holds the requests of a peer until they are uploaded. Queued requests
+// can still be cancelled by the peer, and are all dropped when we choke it
+type RequestQueue struct {
+	mu      sync.Mutex
+	pending []*message.Message
+	signal  chan struct{}
+}
+
+// NewRequestQueue creates an empty queue
+func NewRequestQueue() *RequestQueue {
+	return &RequestQueue{signal: make(chan struct{}, 1)}
+}
+
+// Push queues a REQUEST message
+func (q *RequestQueue) Push(msg *message.Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) >= MaxQueuedRequests {
 		return
 	}
-	conn.Write(res.Serialize())
-	Payload := torrent.Bitfield
-	bitField := message.Message{ID: message.Bitfield, Payload: Payload}
-	conn.Write(bitField.Serialize())
+	q.pending = append(q.pending, msg)
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Cancel removes the request a CANCEL message refers to
+func (q *RequestQueue) Cancel(msg *message.Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, pending := range q.pending {
+		if bytes.Equal(pending.Payload, msg.Payload) {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return
+		}
+	}
+}
 
-	// maybe add a checker if the number of goroutines hasn't been overloaded
-	error := connection.SendUnchoke(conn)
+// Clear drops every queued request
+func (q *RequestQueue) Clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = nil
+}
 
-	if error != nil {
-		return
+func (q *RequestQueue) pop() *message.Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return nil
 	}
+	msg := q.pending[0]
+	q.pending = q.pending[1:]
+	return msg
+}
 
+// Serve uploads the queued requests in order until done is closed. Requests still queued
+// when we choke the peer are dropped
+func (q *RequestQueue) Serve(torrent *torrentfile.Torrent, c *connection.Connection, done chan struct{}) {
 	for {
-		requestMessage, err := message.Read(reader)
-		if err != nil {
-			fmt.Errorf("could not read message", requestMessage, err)
+		select {
+		case <-done:
 			return
+		case <-q.signal:
+		}
+		for msg := q.pop(); msg != nil; msg = q.pop() {
+			if c.State().AmChoking {
+				q.Clear()
+				break
+			}
+			err := Upload(torrent, msg, c)
+			if err != nil {
+				log.Printf("could not upload block: %s\n", err)
+			}
 		}
-		go Upload(torrent, requestMessage, conn)
 	}
 }
 
-func HandleSeed(torrent *torrentfile.Torrent, Port uint16) {
-	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", Port))
-
+// Serve accepts the peers connecting on Port, on every interface, and hands their
+// connections to handle
+func Serve(Port uint16, handle func(net.Conn)) error {
+	// Listening on every address accepts both IPv4 and IPv6 peers
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", Port))
 	if err != nil {
-		log.Fatalf("Failed to listen: %s", err)
+		return err
 	}
 
-	log.Printf("Listening on localhost and port: %d ", Port)
+	log.Printf("Listening on all interfaces and port: %d ", Port)
 
 	for {
 		conn, err := ln.Accept()
 		if err == nil {
 			log.Println("Accepted Connection", conn.RemoteAddr().String())
-			go handleConnection(torrent, conn)
+			go handle(conn)
 		}
 	}
 }
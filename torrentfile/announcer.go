@@ -0,0 +1,256 @@
+package torrentfile
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"torrent/peers"
+)
+
+// Events sent along with an announce
+const (
+	EventNone      = ""
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventStopped   = "stopped"
+)
+
+// DefaultInterval is used when the trackers don't tell us how often to announce
+var DefaultInterval = 30 * time.Minute
+
+// RetryInterval is how long we wait before announcing again after every tracker failed
+var RetryInterval = time.Minute
+
+// StopTimeout is how long we try to tell the trackers that we stop, we are shutting down and
+// an unreachable tracker forgets about us after a while anyway
+var StopTimeout = 5 * time.Second
+
+// AnnounceRequest is what we report to the trackers when announcing
+type AnnounceRequest struct {
+	PeerID     [20]byte
+	Port       uint16
+	Uploaded   int
+	Downloaded int
+	Left       int
+	Event      string
+	TrackerID  string
+	IPv6       net.IP
+}
+
+// AnnounceResponse is what the trackers answered to an announce, merged over every tier.
+// Complete and Incomplete are the largest swarm sizes reported by a tracker
+type AnnounceResponse struct {
+	Peers       []peers.Peer
+	Interval    int
+	MinInterval int
+	Complete    int
+	Incomplete  int
+	Warnings    []string
+}
+
+// Stats counts the payload bytes exchanged with peers. It is shared by every copy of a Torrent
+type Stats struct {
+	uploaded   int64
+	downloaded int64
+}
+
+// AddUploaded records n bytes sent to peers
+func (s *Stats) AddUploaded(n int) {
+	atomic.AddInt64(&s.uploaded, int64(n))
+}
+
+// AddDownloaded records n verified bytes received from peers
+func (s *Stats) AddDownloaded(n int) {
+	atomic.AddInt64(&s.downloaded, int64(n))
+}
+
+// Uploaded returns the number of bytes sent to peers
+func (s *Stats) Uploaded() int {
+	return int(atomic.LoadInt64(&s.uploaded))
+}
+
+// Downloaded returns the number of verified bytes received from peers
+func (s *Stats) Downloaded() int {
+	return int(atomic.LoadInt64(&s.downloaded))
+}
+
+// Left returns the number of bytes we still have to download
+func (t *Torrent) Left() int {
+	left := t.Length
+	for index := range t.PieceHashes {
+		if t.HasPiece(index) {
+			left -= t.PieceSize(index)
+		}
+	}
+	return left
+}
+
+// LocalIPv6 returns a global IPv6 address of this host, nil when we only have IPv4.
+// Trackers reached over IPv4 learn from it that we can be contacted over IPv6 as well
+func LocalIPv6() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP
+		if ip.To4() == nil && ip.IsGlobalUnicast() && !ip.IsPrivate() {
+			return ip
+		}
+	}
+	return nil
+}
+
+// Announcer keeps the trackers informed about our progress on a torrent. It announces
+// periodically as the trackers ask us to and hands the peers they return to OnPeers
+type Announcer struct {
+	Torrent *Torrent
+	PeerID  [20]byte
+	Port    uint16
+	IPv6    net.IP
+	OnPeers func([]peers.Peer)
+
+	started   bool
+	completed chan struct{}
+	ctx       context.Context // cancelled by Stop, aborting the announce in progress
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// NewAnnouncer creates an Announcer for a torrent, it does nothing until started
+func NewAnnouncer(t *Torrent, peerID [20]byte, port uint16, onPeers func([]peers.Peer)) *Announcer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Announcer{
+		Torrent:   t,
+		PeerID:    peerID,
+		Port:      port,
+		IPv6:      LocalIPv6(),
+		OnPeers:   onPeers,
+		completed: make(chan struct{}, 1),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+}
+
+func (a *Announcer) request(event string) AnnounceRequest {
+	req := AnnounceRequest{
+		PeerID: a.PeerID,
+		Port:   a.Port,
+		Left:   a.Torrent.Left(),
+		Event:  event,
+		IPv6:   a.IPv6,
+	}
+	if a.Torrent.Stats != nil {
+		req.Uploaded = a.Torrent.Stats.Uploaded()
+		req.Downloaded = a.Torrent.Stats.Downloaded()
+	}
+	return req
+}
+
+// announces and tells how long to wait until the next periodic announce. Every tracker has
+// timeout to answer, 0 waits for the whole BEP 15 schedule
+func (a *Announcer) announce(ctx context.Context, event string, timeout time.Duration) (*AnnounceResponse, time.Duration, error) {
+	resp, err := a.Torrent.sendAnnounce(ctx, a.request(event), timeout)
+	if err != nil {
+		return nil, RetryInterval, err
+	}
+
+	wait := time.Duration(resp.Interval) * time.Second
+	if wait <= 0 {
+		wait = DefaultInterval
+	}
+	if minWait := time.Duration(resp.MinInterval) * time.Second; wait < minWait {
+		wait = minWait
+	}
+	return resp, wait, nil
+}
+
+// Start sends the started event and keeps announcing in the background until Stop is called.
+// The peers of the first announce are returned instead of being passed to OnPeers. When no
+// tracker answers, the started event is sent again after RetryInterval
+func (a *Announcer) Start() ([]peers.Peer, error) {
+	resp, wait, err := a.announce(a.ctx, EventStarted, TrackerTimeout)
+	a.started = true
+	if err != nil {
+		go a.run(wait, EventStarted)
+		return nil, err
+	}
+	go a.run(wait, EventNone)
+	return resp.Peers, nil
+}
+
+// announces periodically, pending being an event no tracker heard about yet
+func (a *Announcer) run(wait time.Duration, pending string) {
+	defer close(a.done)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		event := pending
+		select {
+		case <-a.ctx.Done():
+			a.announceStop()
+			return
+		case <-a.completed:
+			event = EventCompleted
+		case <-timer.C:
+		}
+
+		// Nobody waits on the periodic announces, slow trackers get all the time they need
+		resp, next, err := a.announce(a.ctx, event, 0)
+		pending = EventNone
+		if err != nil {
+			pending = event
+			if a.ctx.Err() != nil {
+				continue
+			}
+			log.Printf("Announce failed, retrying in %s: %s\n", next, err)
+		} else if a.OnPeers != nil && len(resp.Peers) > 0 {
+			a.OnPeers(resp.Peers)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(next)
+	}
+}
+
+// sends the stopped event, giving up after StopTimeout
+func (a *Announcer) announceStop() {
+	ctx, cancel := context.WithTimeout(context.Background(), StopTimeout)
+	defer cancel()
+	_, _, err := a.announce(ctx, EventStopped, 0)
+	if err != nil {
+		log.Printf("Could not announce stop: %s\n", err)
+	}
+}
+
+// Completed tells the trackers that we finished downloading the torrent
+func (a *Announcer) Completed() {
+	select {
+	case a.completed <- struct{}{}:
+	default:
+	}
+}
+
+// Stop aborts the announce in progress and sends the stopped event, which takes at most
+// StopTimeout
+func (a *Announcer) Stop() {
+	if !a.started {
+		return
+	}
+	a.cancel()
+	<-a.done
+}
@@ -0,0 +1,35 @@
+package torrentfile
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAnnouncerStopDoesNotWait(t *testing.T) {
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	defer func(tracker, retry, stop time.Duration) {
+		TrackerTimeout, RetryInterval, StopTimeout = tracker, retry, stop
+	}(TrackerTimeout, RetryInterval, StopTimeout)
+	TrackerTimeout = 100 * time.Millisecond
+	RetryInterval = 0 // the periodic announce starts right away and waits on the tracker
+	StopTimeout = 200 * time.Millisecond
+
+	torrent := &Torrent{AnnounceList: [][]string{{"udp://" + silent.LocalAddr().String()}}, InfoHash: [20]byte{1}}
+	announcer := NewAnnouncer(torrent, [20]byte{2}, 6881, nil)
+	if _, err := announcer.Start(); err == nil {
+		t.Fatal("start succeeded with a silent tracker")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	announcer.Stop()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("stop took %s", elapsed)
+	}
+}
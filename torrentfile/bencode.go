@@ -0,0 +1,85 @@
+package torrentfile
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// valueLength returns how many bytes the bencoded value at the start of buf takes
+func valueLength(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, fmt.Errorf("unexpected end of bencoded data")
+	}
+	switch c := buf[0]; {
+	case c == 'i':
+		end := bytes.IndexByte(buf, 'e')
+		if end < 0 {
+			return 0, fmt.Errorf("unterminated integer")
+		}
+		if _, err := strconv.ParseInt(string(buf[1:end]), 10, 64); err != nil {
+			return 0, fmt.Errorf("malformed integer %q", buf[1:end])
+		}
+		return end + 1, nil
+	case c == 'l' || c == 'd':
+		curr := 1
+		for {
+			if curr >= len(buf) {
+				return 0, fmt.Errorf("unterminated list or dictionary")
+			}
+			if buf[curr] == 'e' {
+				return curr + 1, nil
+			}
+			n, err := valueLength(buf[curr:])
+			if err != nil {
+				return 0, err
+			}
+			curr += n
+		}
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(buf, ':')
+		if colon < 0 {
+			return 0, fmt.Errorf("malformed string length")
+		}
+		length, err := strconv.Atoi(string(buf[:colon]))
+		if err != nil || length < 0 {
+			return 0, fmt.Errorf("malformed string length %q", buf[:colon])
+		}
+		if colon+1+length > len(buf) {
+			return 0, fmt.Errorf("string of length %d runs past the end of the data", length)
+		}
+		return colon + 1 + length, nil
+	}
+	return 0, fmt.Errorf("unexpected byte %q in bencoded data", buf[0])
+}
+
+// dictValue returns the exact bytes of the value stored under key in the
+// top level dictionary of buf, without decoding and re-encoding it
+func dictValue(buf []byte, key string) ([]byte, error) {
+	if len(buf) == 0 || buf[0] != 'd' {
+		return nil, fmt.Errorf("expected a bencoded dictionary")
+	}
+	curr := 1
+	for curr < len(buf) && buf[curr] != 'e' {
+		keyLength, err := valueLength(buf[curr:])
+		if err != nil {
+			return nil, err
+		}
+		if buf[curr] < '0' || buf[curr] > '9' {
+			return nil, fmt.Errorf("dictionary key is not a string")
+		}
+		k := buf[curr : curr+keyLength]
+		k = k[bytes.IndexByte(k, ':')+1:]
+		curr += keyLength
+
+		valLength, err := valueLength(buf[curr:])
+		if err != nil {
+			return nil, err
+		}
+		if string(k) == key {
+			return buf[curr : curr+valLength], nil
+		}
+		curr += valLength
+	}
+	return nil, fmt.Errorf("key %q not found", key)
+}
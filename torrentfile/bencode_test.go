@@ -0,0 +1,46 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInfoHashOfRawInfo(t *testing.T) {
+	// Keys out of order and one we don't know about: re-encoding would give other bytes
+	rawInfo := "d4:name4:test6:lengthi5e12:piece lengthi16384e6:pieces20:0123456789abcdefghij7:privatei1e6:sourcel1:xd1:yi2eeee"
+	data := "d8:announce20:http://tracker/annou7:comment4:info4:info" + rawInfo + "4:zzzzi0ee"
+	path := filepath.Join(t.TempDir(), "test.torrent")
+	if err := os.WriteFile(path, []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	torrentFile, err := ParseFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(torrentFile.RawInfo) != rawInfo {
+		t.Errorf("got raw info %q, want %q", torrentFile.RawInfo, rawInfo)
+	}
+	if torrentFile.InfoHash != sha1.Sum([]byte(rawInfo)) {
+		t.Errorf("info-hash %x is not the hash of the raw info dictionary", torrentFile.InfoHash)
+	}
+	if torrentFile.Name != "test" || torrentFile.Length != 5 {
+		t.Errorf("got name %q and length %d", torrentFile.Name, torrentFile.Length)
+	}
+}
+
+func TestDictValue(t *testing.T) {
+	buf := []byte("d1:ad4:infoi1ee1:bli1e3:abce4:infod1:xi-3eee")
+	value, err := dictValue(buf, "info")
+	if err != nil || string(value) != "d1:xi-3ee" {
+		t.Errorf("got %q, %v", value, err)
+	}
+
+	for _, malformed := range []string{"", "le", "d4:info", "d4:infoi1", "di1e4:infoe", "d4:info5:abce"} {
+		if value, err := dictValue([]byte(malformed), "info"); err == nil {
+			t.Errorf("%q: got %q without error", malformed, value)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package torrentfile
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+
+	"torrent/peers"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// TrackerResponse is the response we get from the tracker
+type TrackerResponse struct {
+	Interval       int
+	MinInterval    int
+	TrackerID      string
+	Complete       int
+	Incomplete     int
+	WarningMessage string
+	Peers          []peers.Peer
+}
+
+// TrackerError is returned when a tracker refuses an announce or a scrape
+type TrackerError struct {
+	Tracker string
+	Reason  string
+}
+
+func (e *TrackerError) Error() string {
+	return fmt.Sprintf("tracker refused the request: %s", e.Reason)
+}
+
+// returns an integer field of a decoded dictionary, 0 when missing
+func intField(dict map[string]interface{}, key string) int {
+	value, _ := dict[key].(int64)
+	return int(value)
+}
+
+// parses the dictionary model of the peer list (compact=0). Host names are resolved within
+// ctx, the announce deadline
+func parsePeerDicts(ctx context.Context, list []interface{}) ([]peers.Peer, error) {
+	found := make([]peers.Peer, 0, len(list))
+	for _, item := range list {
+		dict, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("peer entry is not a dictionary")
+		}
+		host, _ := dict["ip"].(string)
+		port := intField(dict, "port")
+		if port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("peer %s has invalid port %d", host, port)
+		}
+
+		ip := net.ParseIP(host)
+		if ip == nil {
+			// The ip key may also hold a DNS name
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil || len(addrs) == 0 {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				continue
+			}
+			ip = addrs[0].IP
+		}
+		found = append(found, peers.Peer{IP: ip, Port: uint16(port)})
+	}
+	return found, nil
+}
+
+// decodes the bencoded answer of an HTTP tracker, accepting both the compact and the
+// dictionary model of the peer list
+func decodeTrackerResponse(ctx context.Context, tracker string, r io.Reader) (*TrackerResponse, error) {
+	decoded, err := bencode.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("tracker %s answered with something else than a dictionary", tracker)
+	}
+
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, &TrackerError{Tracker: tracker, Reason: reason}
+	}
+
+	resp := TrackerResponse{
+		Interval:    intField(dict, "interval"),
+		MinInterval: intField(dict, "min interval"),
+		Complete:    intField(dict, "complete"),
+		Incomplete:  intField(dict, "incomplete"),
+	}
+	resp.TrackerID, _ = dict["tracker id"].(string)
+	resp.WarningMessage, _ = dict["warning message"].(string)
+
+	switch peerList := dict["peers"].(type) {
+	case string:
+		resp.Peers, err = peers.Unmarshal([]byte(peerList))
+	case []interface{}:
+		resp.Peers, err = parsePeerDicts(ctx, peerList)
+	case nil:
+	default:
+		err = fmt.Errorf("unexpected peers type %T", peerList)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if peers6, ok := dict["peers6"].(string); ok {
+		found, err := peers.Unmarshal6([]byte(peers6))
+		if err != nil {
+			return nil, err
+		}
+		resp.Peers = append(resp.Peers, found...)
+	}
+	return &resp, nil
+}
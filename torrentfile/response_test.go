@@ -0,0 +1,27 @@
+package torrentfile
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDecodePeerDicts(t *testing.T) {
+	body := "d8:intervali1800e5:peersld2:ip8:10.0.0.14:porti6881eed2:ip9:localhost4:porti6882eeee"
+	resp, err := decodeTrackerResponse(context.Background(), "test", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Peers) == 0 || resp.Peers[0].String() != "10.0.0.1:6881" {
+		t.Errorf("got peers %v", resp.Peers)
+	}
+
+	// Host names are resolved within the announce deadline
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = decodeTrackerResponse(ctx, "test", strings.NewReader(body))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want the lookup to be cancelled", err)
+	}
+}
@@ -0,0 +1,193 @@
+package torrentfile
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// ScrapeResult holds the swarm statistics a tracker reports for an info-hash
+type ScrapeResult struct {
+	Complete   int
+	Downloaded int
+	Incomplete int
+}
+
+// ScrapeURL derives the scrape URL of an HTTP tracker from its announce URL. By convention
+// the last path component starts with "announce" which is replaced by "scrape"
+func ScrapeURL(announce string) (string, error) {
+	base, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	slash := strings.LastIndex(base.Path, "/")
+	if slash < 0 || !strings.HasPrefix(base.Path[slash+1:], "announce") {
+		return "", fmt.Errorf("tracker %s does not support scrape", announce)
+	}
+	base.Path = base.Path[:slash+1] + "scrape" + strings.TrimPrefix(base.Path[slash+1:], "announce")
+	return base.String(), nil
+}
+
+// scrapes an HTTP tracker
+func scrapeHTTP(ctx context.Context, tracker string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	scrapeURL, err := ScrapeURL(tracker)
+	if err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(scrapeURL)
+	if err != nil {
+		return nil, err
+	}
+	params := base.Query()
+	for _, infoHash := range infoHashes {
+		params.Add("info_hash", string(infoHash[:]))
+	}
+	base.RawQuery = params.Encode()
+
+	resp, err := httpGet(ctx, base.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	decoded, err := bencode.Decode(resp.Body)
+	if err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("tracker %s answered with status %s", tracker, resp.Status)
+		}
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("tracker %s answered with something else than a dictionary", tracker)
+	}
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, &TrackerError{Tracker: tracker, Reason: reason}
+	}
+
+	files, _ := dict["files"].(map[string]interface{})
+	results := map[[20]byte]ScrapeResult{}
+	for key, value := range files {
+		stats, ok := value.(map[string]interface{})
+		if !ok || len(key) != 20 {
+			continue
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], key)
+		results[infoHash] = ScrapeResult{
+			Complete:   intField(stats, "complete"),
+			Downloaded: intField(stats, "downloaded"),
+			Incomplete: intField(stats, "incomplete"),
+		}
+	}
+	return results, nil
+}
+
+// scrapes a UDP tracker, splitting the info-hashes in batches that fit in a packet
+func scrapeUDP(ctx context.Context, host string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	client, err := newUDPClient(host)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	results := map[[20]byte]ScrapeResult{}
+	for start := 0; start < len(infoHashes); start += MaxScrapeHashes {
+		end := start + MaxScrapeHashes
+		if end > len(infoHashes) {
+			end = len(infoHashes)
+		}
+		batch, err := client.scrape(ctx, infoHashes[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for i, result := range batch {
+			results[infoHashes[start+i]] = result
+		}
+	}
+	return results, nil
+}
+
+// Scrape asks a tracker for the swarm statistics of one or more info-hashes without announcing
+func Scrape(ctx context.Context, tracker string, infoHashes ...[20]byte) (map[[20]byte]ScrapeResult, error) {
+	base, err := url.Parse(tracker)
+	if err != nil {
+		return nil, err
+	}
+	switch base.Scheme {
+	case "http", "https":
+		return scrapeHTTP(ctx, tracker, infoHashes)
+	case "udp":
+		return scrapeUDP(ctx, base.Host, infoHashes)
+	}
+	return nil, fmt.Errorf("unsupported tracker scheme %q", base.Scheme)
+}
+
+// scrapes the first tracker of every tier able to answer, all tiers at the same time. Every
+// tracker has TrackerTimeout to answer
+func scrapeTiers(ctx context.Context, tiers [][]string, infoHash [20]byte) (map[string]ScrapeResult, error) {
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("torrent has no trackers")
+	}
+
+	type tierResult struct {
+		tracker string
+		result  ScrapeResult
+		err     error
+	}
+	results := make(chan tierResult, len(tiers))
+	for _, tier := range tiers {
+		go func(tier []string) {
+			var lastErr error
+			for _, tracker := range tier {
+				trackerCtx, cancel := trackerContext(ctx, TrackerTimeout)
+				found, err := Scrape(trackerCtx, tracker, infoHash)
+				cancel()
+				if err != nil {
+					log.Printf("Scrape of %s failed: %s\n", tracker, err)
+					lastErr = err
+					continue
+				}
+				result, ok := found[infoHash]
+				if !ok {
+					lastErr = fmt.Errorf("tracker %s does not know the torrent", tracker)
+					continue
+				}
+				results <- tierResult{tracker: tracker, result: result}
+				return
+			}
+			results <- tierResult{err: lastErr}
+		}(tier)
+	}
+
+	merged := map[string]ScrapeResult{}
+	var lastErr error
+	for range tiers {
+		res := <-results
+		if res.err != nil {
+			lastErr = res.err
+			continue
+		}
+		merged[res.tracker] = res.result
+	}
+	if len(merged) == 0 {
+		return nil, fmt.Errorf("no tracker answered the scrape: %w", lastErr)
+	}
+	return merged, nil
+}
+
+// Scrape returns the swarm statistics of the torrent as reported by each tracker that answered
+func (t *Torrent) Scrape(ctx context.Context) (map[string]ScrapeResult, error) {
+	return scrapeTiers(ctx, t.Trackers(), t.InfoHash)
+}
+
+// Scrape returns the swarm statistics of the torrent as reported by each tracker that answered.
+// Unlike a Torrent, a TorrentFile has no files open on disk
+func (t *TorrentFile) Scrape(ctx context.Context) (map[string]ScrapeResult, error) {
+	return scrapeTiers(ctx, newTrackerTiers(t.Announce, t.AnnounceList).snapshot(), t.InfoHash)
+}
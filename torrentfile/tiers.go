@@ -0,0 +1,193 @@
+package torrentfile
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"torrent/peers"
+)
+
+// TrackerTimeout is how long a tracker has to answer before we give up on it, enough for
+// two transmissions to a UDP tracker. Only the periodic announces of an Announcer wait for
+// the whole BEP 15 retransmission schedule
+var TrackerTimeout = 45 * time.Second
+
+// trackerTiers keeps the trackers of a torrent in the order they should be tried (BEP 12)
+type trackerTiers struct {
+	sync.Mutex
+	tiers      [][]string
+	trackerIDs map[string]string
+}
+
+// builds the tiers from the announce-list, shuffling every tier. Without an announce-list
+// the announce URL is the only tier
+func newTrackerTiers(announce string, announceList [][]string) *trackerTiers {
+	tiers := [][]string{}
+	for _, tier := range announceList {
+		if len(tier) == 0 {
+			continue
+		}
+		shuffled := append([]string{}, tier...)
+		rand.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		tiers = append(tiers, shuffled)
+	}
+	if len(tiers) == 0 && announce != "" {
+		tiers = append(tiers, []string{announce})
+	}
+	return &trackerTiers{tiers: tiers, trackerIDs: map[string]string{}}
+}
+
+// returns the tracker id a tracker asked us to send back in our next announces
+func (tt *trackerTiers) trackerID(tracker string) string {
+	tt.Lock()
+	defer tt.Unlock()
+	return tt.trackerIDs[tracker]
+}
+
+func (tt *trackerTiers) setTrackerID(tracker, id string) {
+	tt.Lock()
+	defer tt.Unlock()
+	tt.trackerIDs[tracker] = id
+}
+
+// returns a copy of the tiers that can be iterated while other announces reorder them
+func (tt *trackerTiers) snapshot() [][]string {
+	tt.Lock()
+	defer tt.Unlock()
+	tiers := make([][]string, len(tt.tiers))
+	for i, tier := range tt.tiers {
+		tiers[i] = append([]string{}, tier...)
+	}
+	return tiers
+}
+
+// moves a tracker that answered to the front of its tier
+func (tt *trackerTiers) promote(tier int, tracker string) {
+	tt.Lock()
+	defer tt.Unlock()
+	trackers := tt.tiers[tier]
+	for i, t := range trackers {
+		if t == tracker {
+			copy(trackers[1:i+1], trackers[:i])
+			trackers[0] = tracker
+			return
+		}
+	}
+}
+
+// Trackers returns the trackers of the torrent grouped in tiers, in the order they are tried
+func (t *Torrent) Trackers() [][]string {
+	if t.tiers == nil {
+		t.tiers = newTrackerTiers(t.Announce, t.AnnounceList)
+	}
+	return t.tiers.snapshot()
+}
+
+// bounds the time a single tracker has to answer, no bound when timeout is 0
+func trackerContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// announces to the trackers of a tier one after the other until one of them answers
+func (t *Torrent) announceTier(ctx context.Context, index int, tier []string, req AnnounceRequest, timeout time.Duration) (*TrackerResponse, error) {
+	var lastErr error
+	for _, tracker := range tier {
+		trackerCtx, cancel := trackerContext(ctx, timeout)
+		resp, err := t.announce(trackerCtx, tracker, req)
+		cancel()
+		if err != nil {
+			log.Printf("Tracker %s failed: %s\n", tracker, err)
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		t.tiers.promote(index, tracker)
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// SendAnnounce announces to the trackers tier after tier as described in BEP 12 and merges the
+// peers returned by the tracker that answered in each tier. Within a tier the trackers are
+// tried in order and the one that answered moves to the front of its tier. Every tracker has
+// TrackerTimeout
+func (t *Torrent) SendAnnounce(ctx context.Context, req AnnounceRequest) (*AnnounceResponse, error) {
+	return t.sendAnnounce(ctx, req, TrackerTimeout)
+}
+
+// announces giving every tracker timeout to answer, 0 waits for as long as ctx allows
+func (t *Torrent) sendAnnounce(ctx context.Context, req AnnounceRequest, timeout time.Duration) (*AnnounceResponse, error) {
+	tiers := t.Trackers()
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("torrent has no trackers")
+	}
+
+	merged := AnnounceResponse{}
+	seen := map[string]bool{}
+	answered := false
+	var lastErr error
+	for index, tier := range tiers {
+		resp, err := t.announceTier(ctx, index, tier, req, timeout)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		answered = true
+
+		// The tracker wanting to hear from us the soonest decides when we announce again
+		if resp.Interval > 0 && (merged.Interval == 0 || resp.Interval < merged.Interval) {
+			merged.Interval = resp.Interval
+		}
+		if resp.MinInterval > merged.MinInterval {
+			merged.MinInterval = resp.MinInterval
+		}
+		if resp.Complete > merged.Complete {
+			merged.Complete = resp.Complete
+		}
+		if resp.Incomplete > merged.Incomplete {
+			merged.Incomplete = resp.Incomplete
+		}
+		if resp.WarningMessage != "" {
+			merged.Warnings = append(merged.Warnings, resp.WarningMessage)
+		}
+		for _, peer := range resp.Peers {
+			if !seen[peer.String()] {
+				seen[peer.String()] = true
+				merged.Peers = append(merged.Peers, peer)
+			}
+		}
+	}
+	if !answered {
+		return nil, fmt.Errorf("no tracker answered: %w", lastErr)
+	}
+	return &merged, nil
+}
+
+// GetPeers announces that we are starting to download the torrent and returns the peers
+// the trackers know about
+func (t *Torrent) GetPeers(ctx context.Context, peerID [20]byte, port uint16) ([]peers.Peer, error) {
+	resp, err := t.SendAnnounce(ctx, AnnounceRequest{
+		PeerID: peerID,
+		Port:   port,
+		Left:   t.Left(),
+		Event:  EventStarted,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Peers, nil
+}
@@ -0,0 +1,59 @@
+package torrentfile
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+)
+
+// starts an HTTP tracker answering every announce with peers, given in compact form
+func newFakeHTTPTracker(t *testing.T, peers string) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "d8:intervali1800e5:peers%d:%se", len(peers), peers)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/announce"
+}
+
+func TestSendAnnounceMergesTiers(t *testing.T) {
+	first := newFakeHTTPTracker(t, "\x0a\x00\x00\x01\x1a\xe1\x0a\x00\x00\x03\x1a\xe1")  // 10.0.0.1 and 10.0.0.3
+	second := newFakeHTTPTracker(t, "\x0a\x00\x00\x02\x1a\xe1\x0a\x00\x00\x03\x1a\xe1") // 10.0.0.2 and 10.0.0.3
+	torrent := Torrent{AnnounceList: [][]string{{first}, {second}}, InfoHash: [20]byte{1}}
+
+	resp, err := torrent.SendAnnounce(context.Background(), AnnounceRequest{PeerID: [20]byte{2}, Port: 6881})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := []string{}
+	for _, peer := range resp.Peers {
+		found = append(found, peer.String())
+	}
+	sort.Strings(found)
+	want := []string{"10.0.0.1:6881", "10.0.0.2:6881", "10.0.0.3:6881"}
+	if fmt.Sprint(found) != fmt.Sprint(want) {
+		t.Errorf("got peers %v, want %v", found, want)
+	}
+}
+
+func TestSendAnnouncePromotesWithinTier(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	working := newFakeHTTPTracker(t, "\x0a\x00\x00\x01\x1a\xe1")
+	torrent := Torrent{AnnounceList: [][]string{{dead.URL + "/announce", working}}, InfoHash: [20]byte{1}}
+	torrent.Trackers()
+	torrent.tiers.tiers[0] = []string{dead.URL + "/announce", working} // undo the shuffle
+
+	resp, err := torrent.SendAnnounce(context.Background(), AnnounceRequest{PeerID: [20]byte{2}, Port: 6881})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Peers) != 1 {
+		t.Errorf("got peers %v", resp.Peers)
+	}
+	if tiers := torrent.Trackers(); tiers[0][0] != working {
+		t.Errorf("tier is %v, want the working tracker first", tiers[0])
+	}
+}
@@ -2,70 +2,81 @@ package torrentfile
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 	"torrent/bitfield"
 
-	"torrent/peers"
-
 	"github.com/jackpal/bencode-go"
 )
 
-// TrackerResponse is the response we get from the tracker
-type TrackerResponse struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+// File is a single file inside the torrent. Offset is where the file starts
+// when all the files of the torrent are laid out one after the other
+type File struct {
+	Path   []string
+	Length int
+	Offset int
 }
 
 // TorrentFile is the content inside the .torrent file
 type TorrentFile struct {
-	Announce    string
-	InfoHash    [20]byte
-	PieceHashes [][20]byte
-	PieceLength int
-	Length      int
-	Name        string
+	Announce     string
+	AnnounceList [][]string
+	InfoHash     [20]byte
+	PieceHashes  [][20]byte
+	PieceLength  int
+	Length       int
+	Name         string
+	Files        []File
+	RawInfo      []byte
 }
 
-// Torrent is simmilar to TorrentFile but with the file descriptor and bitfield
+// Torrent is simmilar to TorrentFile but with the file descriptors and bitfield
 type Torrent struct {
-	Announce    string
-	InfoHash    [20]byte
-	PieceHashes [][20]byte
-	PieceLength int
-	Length      int
-	Name        string
-	File        *os.File
-	Bitfield    bitfield.Bitfield
+	Announce     string
+	AnnounceList [][]string
+	InfoHash     [20]byte
+	PieceHashes  [][20]byte
+	PieceLength  int
+	Length       int
+	Name         string
+	Files        []File
+	RawInfo      []byte
+	Bitfield     bitfield.Bitfield
+	Stats        *Stats
+	handles      []*os.File
+	tiers        *trackerTiers
+	pieceMu      *sync.RWMutex // guards Bitfield once peers are downloading and uploading
 }
 
-type bencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
 }
 
-type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+type bencodeInfo struct {
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length"`
+	Name        string        `bencode:"name"`
+	Files       []bencodeFile `bencode:"files"`
 }
 
-// gives us the infoHash
-func (i *bencodeInfo) hash() ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, *i)
-	if err != nil {
-		return [20]byte{}, err
-	}
-	h := sha1.Sum(buf.Bytes())
-	return h, nil
+type bencodeTorrent struct {
+	Announce     string      `bencode:"announce"`
+	AnnounceList [][]string  `bencode:"announce-list"`
+	Info         bencodeInfo `bencode:"info"`
 }
 
 // hashes the individual pieces one by one
@@ -85,28 +96,88 @@ func (i *bencodeInfo) hashPieces() ([][20]byte, error) {
 	return hashes, nil
 }
 
-// changes bencode torrent into torrentfile
-func (bto *bencodeTorrent) ParseTorrentFile() (TorrentFile, error) {
-	infoHash, err := bto.Info.hash()
-	if err != nil {
-		return TorrentFile{}, err
+// tells if a name can be used as a file or directory name without leaving the download
+// directory. Names come from the torrent, which may come from any peer
+func validPathComponent(component string) bool {
+	if component == "" || component == "." || component == ".." || filepath.IsAbs(component) {
+		return false
+	}
+	return !strings.ContainsAny(component, `/\`)
+}
+
+// lays out the files of the torrent. A single file torrent is treated as a
+// torrent with one file called Name
+func (i *bencodeInfo) files() ([]File, int, error) {
+	if !validPathComponent(i.Name) {
+		return nil, 0, fmt.Errorf("torrent has an invalid name %q", i.Name)
+	}
+	if len(i.Files) == 0 {
+		return []File{{Path: []string{i.Name}, Length: i.Length}}, i.Length, nil
+	}
+
+	files := make([]File, len(i.Files))
+	offset := 0
+	for idx, f := range i.Files {
+		if len(f.Path) == 0 {
+			return nil, 0, fmt.Errorf("file %d has an empty path", idx)
+		}
+		for _, component := range f.Path {
+			if !validPathComponent(component) {
+				return nil, 0, fmt.Errorf("file %d has an invalid path %q", idx, f.Path)
+			}
+		}
+		files[idx] = File{
+			Path:   append([]string{i.Name}, f.Path...),
+			Length: f.Length,
+			Offset: offset,
+		}
+		offset += f.Length
 	}
+	return files, offset, nil
+}
+
+// changes bencode torrent into torrentfile. rawInfo is the info dictionary
+// exactly as it appears in the .torrent file, the infoHash is computed from it
+func (bto *bencodeTorrent) ParseTorrentFile(rawInfo []byte) (TorrentFile, error) {
+	infoHash := sha1.Sum(rawInfo)
 	pieceHashes, err := bto.Info.hashPieces()
 
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	files, length, err := bto.Info.files()
 	if err != nil {
 		return TorrentFile{}, err
 	}
 	t := TorrentFile{
-		Announce:    bto.Announce,
-		InfoHash:    infoHash,
-		PieceHashes: pieceHashes,
-		PieceLength: bto.Info.PieceLength,
-		Length:      bto.Info.Length,
-		Name:        bto.Info.Name,
+		Announce:     bto.Announce,
+		AnnounceList: bto.AnnounceList,
+		InfoHash:     infoHash,
+		PieceHashes:  pieceHashes,
+		PieceLength:  bto.Info.PieceLength,
+		Length:       length,
+		Name:         bto.Info.Name,
+		Files:        files,
+		RawInfo:      rawInfo,
 	}
 	return t, nil
 }
 
+// ParseInfo builds a TorrentFile from a bare info dictionary, as received from
+// peers when starting from a magnet link
+func ParseInfo(rawInfo []byte, announceList [][]string) (TorrentFile, error) {
+	info := bencodeInfo{}
+	err := bencode.Unmarshal(bytes.NewReader(rawInfo), &info)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	bto := bencodeTorrent{AnnounceList: announceList, Info: info}
+	if len(announceList) > 0 && len(announceList[0]) > 0 {
+		bto.Announce = announceList[0][0]
+	}
+	return bto.ParseTorrentFile(rawInfo)
+}
+
 // calculates the bound for a single piece
 func (t *Torrent) PieceBound(index int) (begin int, end int) {
 	begin = index * t.PieceLength
@@ -123,6 +194,72 @@ func (t *Torrent) PieceSize(index int) int {
 	return end - begin
 }
 
+// ReadAt reads len(buf) bytes starting at offset off of the torrent,
+// crossing file boundaries when needed
+func (t *Torrent) ReadAt(buf []byte, off int64) (int, error) {
+	return t.span(buf, off, func(f *os.File, b []byte, at int64) (int, error) {
+		return f.ReadAt(b, at)
+	})
+}
+
+// WriteAt writes buf starting at offset off of the torrent, crossing file
+// boundaries when needed
+func (t *Torrent) WriteAt(buf []byte, off int64) (int, error) {
+	return t.span(buf, off, func(f *os.File, b []byte, at int64) (int, error) {
+		return f.WriteAt(b, at)
+	})
+}
+
+// splits buf over every file that the range [off, off+len(buf)) touches
+func (t *Torrent) span(buf []byte, off int64, op func(*os.File, []byte, int64) (int, error)) (int, error) {
+	if off < 0 || off+int64(len(buf)) > int64(t.Length) {
+		return 0, fmt.Errorf("range [%d, %d) is out of bounds for length %d", off, off+int64(len(buf)), t.Length)
+	}
+	done := 0
+	for idx, file := range t.Files {
+		if done == len(buf) {
+			break
+		}
+		start, end := int64(file.Offset), int64(file.Offset+file.Length)
+		pos := off + int64(done)
+		if pos < start || pos >= end {
+			continue
+		}
+		chunk := buf[done:]
+		if int64(len(chunk)) > end-pos {
+			chunk = chunk[:end-pos]
+		}
+		n, err := op(t.handles[idx], chunk, pos-start)
+		done += n
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+// Sync flushes the data written to the files of the torrent to the disk
+func (t *Torrent) Sync() error {
+	var firstErr error
+	for _, f := range t.handles {
+		if err := f.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close closes every file of the torrent
+func (t *Torrent) Close() error {
+	var firstErr error
+	for _, f := range t.handles {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 // checks if the given piece hash and the hash from the torrent file match
 func checkIntegrity(piece int, piecehash [20]byte, buf []byte) error {
 	bufferhash := sha1.Sum(buf)
@@ -132,6 +269,34 @@ func checkIntegrity(piece int, piecehash [20]byte, buf []byte) error {
 	return nil
 }
 
+// HasPiece tells if a piece was downloaded and verified. Unlike Bitfield.HasPiece it is safe
+// to call while pieces are being set
+func (t *Torrent) HasPiece(index int) bool {
+	if t.pieceMu != nil {
+		t.pieceMu.RLock()
+		defer t.pieceMu.RUnlock()
+	}
+	return t.Bitfield.HasPiece(index)
+}
+
+// SetPiece marks a piece as downloaded and verified
+func (t *Torrent) SetPiece(index int) {
+	if t.pieceMu != nil {
+		t.pieceMu.Lock()
+		defer t.pieceMu.Unlock()
+	}
+	t.Bitfield.SetPiece(index)
+}
+
+// CopyBitfield returns a copy of the bitfield, e.g. to send it to a peer
+func (t *Torrent) CopyBitfield() bitfield.Bitfield {
+	if t.pieceMu != nil {
+		t.pieceMu.RLock()
+		defer t.pieceMu.RUnlock()
+	}
+	return append(bitfield.Bitfield{}, t.Bitfield...)
+}
+
 // Checks if the pieces have been succesfully downloaded
 func (torrent Torrent) Restore() {
 	for piece, hash := range torrent.PieceHashes {
@@ -139,10 +304,10 @@ func (torrent Torrent) Restore() {
 		length := torrent.PieceSize(piece)
 
 		data := make([]byte, length)
-		_, err := torrent.File.ReadAt(data, int64(begin))
+		_, err := torrent.ReadAt(data, int64(begin))
 
 		if err != nil {
-			fmt.Errorf("something went wrong while trying to Reading File", err)
+			continue
 		}
 
 		// Check Integrity of the piece
@@ -155,12 +320,38 @@ func (torrent Torrent) Restore() {
 	}
 }
 
+// opens (and creates when missing) every file of the torrent
+func openFiles(files []File) ([]*os.File, error) {
+	handles := make([]*os.File, 0, len(files))
+	for _, file := range files {
+		path := filepath.Join(file.Path...)
+		if dir := filepath.Dir(path); dir != "." {
+			if err := os.MkdirAll(dir, 0777); err != nil {
+				closeFiles(handles)
+				return nil, err
+			}
+		}
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			closeFiles(handles)
+			return nil, err
+		}
+		handles = append(handles, f)
+	}
+	return handles, nil
+}
+
+func closeFiles(handles []*os.File) {
+	for _, f := range handles {
+		f.Close()
+	}
+}
+
 func (torrentFile TorrentFile) ParseTorrent() (Torrent, error) {
-	outFile, err := os.OpenFile(torrentFile.Name, os.O_RDWR|os.O_CREATE, 0666)
+	handles, err := openFiles(torrentFile.Files)
 	if err != nil {
 		return Torrent{}, err
 	}
-	defer outFile.Close()
 
 	// Instantiate Bitfield
 	lengthPieces := float64(len(torrentFile.PieceHashes))
@@ -168,14 +359,20 @@ func (torrentFile TorrentFile) ParseTorrent() (Torrent, error) {
 	bitField := make(bitfield.Bitfield, int(math.Ceil(float64(lengthPieces)/ByteSize)))
 
 	t := Torrent{
-		Announce:    torrentFile.Announce,
-		InfoHash:    torrentFile.InfoHash,
-		PieceHashes: torrentFile.PieceHashes,
-		PieceLength: torrentFile.PieceLength,
-		Length:      torrentFile.Length,
-		Name:        torrentFile.Name,
-		File:        outFile,
-		Bitfield:    bitField,
+		Announce:     torrentFile.Announce,
+		AnnounceList: torrentFile.AnnounceList,
+		InfoHash:     torrentFile.InfoHash,
+		PieceHashes:  torrentFile.PieceHashes,
+		PieceLength:  torrentFile.PieceLength,
+		Length:       torrentFile.Length,
+		Name:         torrentFile.Name,
+		Files:        torrentFile.Files,
+		RawInfo:      torrentFile.RawInfo,
+		Bitfield:     bitField,
+		Stats:        &Stats{},
+		handles:      handles,
+		tiers:        newTrackerTiers(torrentFile.Announce, torrentFile.AnnounceList),
+		pieceMu:      &sync.RWMutex{},
 	}
 
 	t.Restore()
@@ -183,64 +380,144 @@ func (torrentFile TorrentFile) ParseTorrent() (Torrent, error) {
 	return t, nil
 }
 
-// Unmarshal unmarshals .torrent file to torrent struct
-func Unmarshal(path string) (Torrent, error) {
-	file, err := os.Open(path)
+// ParseFile reads a .torrent file without creating the files it describes
+func ParseFile(path string) (TorrentFile, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return Torrent{}, err
+		return TorrentFile{}, err
 	}
 
 	bto := bencodeTorrent{}
-	err = bencode.Unmarshal(file, &bto)
+	err = bencode.Unmarshal(bytes.NewReader(data), &bto)
 	if err != nil {
-		return Torrent{}, err
+		return TorrentFile{}, err
+	}
+
+	// The info dictionary is hashed as is, re-encoding it would drop the keys we don't know about
+	rawInfo, err := dictValue(data, "info")
+	if err != nil {
+		return TorrentFile{}, fmt.Errorf("could not locate the info dictionary: %w", err)
 	}
 
-	torrentFile, err := bto.ParseTorrentFile()
+	torrentFile, err := bto.ParseTorrentFile(rawInfo)
 
 	if err != nil {
-		return Torrent{}, fmt.Errorf("Something went wrong while parsing TorrentFile", err)
+		return TorrentFile{}, fmt.Errorf("Something went wrong while parsing TorrentFile: %w", err)
+	}
+	return torrentFile, nil
+}
+
+// Unmarshal unmarshals .torrent file to torrent struct
+func Unmarshal(path string) (Torrent, error) {
+	torrentFile, err := ParseFile(path)
+	if err != nil {
+		return Torrent{}, err
 	}
 
 	return torrentFile.ParseTorrent()
 
 }
 
-func (t *Torrent) EncodeURL(peerID [20]byte, Port uint16) (string, error) {
-	base, err := url.Parse(t.Announce)
+func (t *Torrent) EncodeURL(tracker string, req AnnounceRequest) (string, error) {
+	base, err := url.Parse(tracker)
 	if err != nil {
 		return "", err
 	}
 	params := url.Values{
 		"info_hash":  []string{string(t.InfoHash[:])},
-		"peer_id":    []string{string(peerID[:])},
-		"port":       []string{strconv.Itoa(int(Port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
+		"peer_id":    []string{string(req.PeerID[:])},
+		"port":       []string{strconv.Itoa(int(req.Port))},
+		"uploaded":   []string{strconv.Itoa(req.Uploaded)},
+		"downloaded": []string{strconv.Itoa(req.Downloaded)},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(t.Length)},
+		"left":       []string{strconv.Itoa(req.Left)},
+	}
+	if req.Event != EventNone {
+		params.Set("event", req.Event)
+	}
+	if req.TrackerID != "" {
+		params.Set("trackerid", req.TrackerID)
+	}
+	if req.IPv6 != nil {
+		params.Set("ipv6", req.IPv6.String())
 	}
 
 	base.RawQuery = params.Encode()
 	return base.String(), nil
 }
 
-func (t *Torrent) GetPeers(peerID [20]byte, port uint16) ([]peers.Peer, error) {
-	url, err := t.EncodeURL(peerID, port)
+// HTTPTimeout is how long an HTTP tracker has to answer an announce or a scrape
+var HTTPTimeout = 30 * time.Second
+
+// sends a GET request to an HTTP tracker
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := http.Client{Timeout: HTTPTimeout}
+	return client.Do(req)
+}
+
+// announces to an HTTP tracker
+func (t *Torrent) announceHTTP(ctx context.Context, tracker string, req AnnounceRequest) (*TrackerResponse, error) {
+	url, err := t.EncodeURL(tracker, req)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := http.Get(url)
+	resp, err := httpGet(ctx, url)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	trackerResp := TrackerResponse{}
-	err = bencode.Unmarshal(resp.Body, &trackerResp)
+	trackerResp, err := decodeTrackerResponse(ctx, tracker, resp.Body)
 	if err != nil {
+		var trackerErr *TrackerError
+		if resp.StatusCode != http.StatusOK && !errors.As(err, &trackerErr) {
+			return nil, fmt.Errorf("tracker %s answered with status %s", tracker, resp.Status)
+		}
 		return nil, err
 	}
+	return trackerResp, nil
+}
 
-	return peers.Unmarshal([]byte(trackerResp.Peers))
+// announces to a UDP tracker (BEP 15)
+func (t *Torrent) announceUDP(ctx context.Context, host string, req AnnounceRequest) (*TrackerResponse, error) {
+	client, err := newUDPClient(host)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	return client.announce(ctx, t.InfoHash, req)
+}
+
+// announces to a single tracker. The tracker protocol is picked from the scheme of the URL
+func (t *Torrent) announce(ctx context.Context, tracker string, req AnnounceRequest) (*TrackerResponse, error) {
+	base, err := url.Parse(tracker)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *TrackerResponse
+	switch base.Scheme {
+	case "http", "https":
+		req.TrackerID = t.tiers.trackerID(tracker)
+		resp, err = t.announceHTTP(ctx, tracker, req)
+	case "udp":
+		resp, err = t.announceUDP(ctx, base.Host, req)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", base.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.TrackerID != "" {
+		t.tiers.setTrackerID(tracker, resp.TrackerID)
+	}
+	if resp.WarningMessage != "" {
+		log.Printf("Tracker %s warns: %s\n", tracker, resp.WarningMessage)
+	}
+	return resp, nil
 }
@@ -0,0 +1,105 @@
+package torrentfile
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// creates the files of a torrent in a temporary directory
+func newTestTorrent(t *testing.T, lengths ...int) *Torrent {
+	dir := t.TempDir()
+	files := []File{}
+	offset := 0
+	for i, length := range lengths {
+		files = append(files, File{Path: []string{dir, string(rune('a' + i))}, Length: length, Offset: offset})
+		offset += length
+	}
+	handles, err := openFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeFiles(handles) })
+	return &Torrent{Length: offset, Files: files, handles: handles}
+}
+
+func TestSpanAcrossFiles(t *testing.T) {
+	torrent := newTestTorrent(t, 5, 0, 7, 0, 4)
+	data := []byte("0123456789abcdef")
+
+	// Two pieces of 8 bytes, each straddling a boundary, the first one two of them
+	for _, begin := range []int{0, 8} {
+		n, err := torrent.WriteAt(data[begin:begin+8], int64(begin))
+		if err != nil || n != 8 {
+			t.Fatalf("wrote %d bytes at %d: %v", n, begin, err)
+		}
+	}
+
+	want := []string{"01234", "", "56789ab", "", "cdef"}
+	for i, file := range torrent.Files {
+		got, err := os.ReadFile(filepath.Join(file.Path...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want[i] {
+			t.Errorf("file %d holds %q, want %q", i, got, want[i])
+		}
+	}
+
+	buf := make([]byte, 6)
+	n, err := torrent.ReadAt(buf, 3)
+	if err != nil || n != 6 || !bytes.Equal(buf, data[3:9]) {
+		t.Errorf("read %q (%d bytes, %v), want %q", buf[:n], n, err, data[3:9])
+	}
+
+	if _, err := torrent.ReadAt(buf, 12); err == nil {
+		t.Errorf("read past the end of the torrent")
+	}
+}
+
+func TestFilesRejectsEscapingPaths(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []bencodeFile
+	}{
+		{"..", nil},
+		{".", nil},
+		{"", nil},
+		{"/etc", nil},
+		{"a/b", nil},
+		{`a\b`, nil},
+		{"ok", []bencodeFile{{Length: 1, Path: []string{"..", "passwd"}}}},
+		{"ok", []bencodeFile{{Length: 1, Path: []string{"/etc", "passwd"}}}},
+		{"ok", []bencodeFile{{Length: 1, Path: []string{"dir", ""}}}},
+		{"ok", []bencodeFile{{Length: 1, Path: []string{"dir/../../x"}}}},
+		{"ok", []bencodeFile{{Length: 1, Path: []string{}}}},
+	}
+	for _, test := range tests {
+		info := bencodeInfo{Name: test.name, Length: 1, Files: test.files}
+		if _, _, err := info.files(); err == nil {
+			t.Errorf("accepted name %q with files %v", test.name, test.files)
+		}
+	}
+}
+
+func TestFilesLayout(t *testing.T) {
+	info := bencodeInfo{Name: "album", Files: []bencodeFile{
+		{Length: 10, Path: []string{"cd1", "01.flac"}},
+		{Length: 0, Path: []string{"empty"}},
+		{Length: 5, Path: []string{"cover.jpg"}},
+	}}
+	files, length, err := info.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if length != 15 {
+		t.Errorf("got length %d, want 15", length)
+	}
+	wantOffsets := []int{0, 10, 10}
+	for i, file := range files {
+		if file.Offset != wantOffsets[i] || file.Path[0] != "album" {
+			t.Errorf("file %d is %+v", i, file)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package torrentfile
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"torrent/peers"
+)
+
+// UDPTimeout is how long we wait for the first answer of a UDP tracker. Every
+// retransmission n waits UDPTimeout * 2^n as described in BEP 15
+var UDPTimeout = 15 * time.Second
+
+// UDPMaxRetries is the number of retransmissions before giving up on a UDP tracker
+var UDPMaxRetries = 8
+
+// UDPConnectionIDLifetime is how long a connection ID obtained from a UDP tracker can be reused
+var UDPConnectionIDLifetime = time.Minute
+
+// MaxScrapeHashes is the largest number of info-hashes that fit in a single UDP scrape
+const MaxScrapeHashes = 74
+
+const udpProtocolID = 0x41727101980
+
+const (
+	actionConnect  = 0
+	actionAnnounce = 1
+	actionScrape   = 2
+	actionError    = 3
+)
+
+type udpConnectionID struct {
+	id       uint64
+	obtained time.Time
+}
+
+// connection IDs are shared between every announce and scrape sent to the same tracker
+var udpConnectionIDs = struct {
+	sync.Mutex
+	ids map[string]udpConnectionID
+}{ids: map[string]udpConnectionID{}}
+
+// the key lets the tracker recognise us if our IP address changes
+var udpKey = func() uint32 {
+	var buf [4]byte
+	rand.Read(buf[:])
+	return binary.BigEndian.Uint32(buf[:])
+}()
+
+// udpClient talks to a single UDP tracker (BEP 15)
+type udpClient struct {
+	host string
+	conn net.Conn
+}
+
+func newUDPClient(host string) (*udpClient, error) {
+	conn, err := net.Dial("udp", host)
+	if err != nil {
+		return nil, err
+	}
+	return &udpClient{host: host, conn: conn}, nil
+}
+
+func (c *udpClient) Close() error {
+	return c.conn.Close()
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// sends a single request and waits for the response carrying the same transaction ID
+func (c *udpClient) exchange(connID uint64, action uint32, body []byte, timeout time.Duration) ([]byte, error) {
+	var txBuf [4]byte
+	_, err := rand.Read(txBuf[:])
+	if err != nil {
+		return nil, err
+	}
+	txID := binary.BigEndian.Uint32(txBuf[:])
+
+	req := make([]byte, 16+len(body))
+	binary.BigEndian.PutUint64(req[0:8], connID)
+	binary.BigEndian.PutUint32(req[8:12], action)
+	binary.BigEndian.PutUint32(req[12:16], txID)
+	copy(req[16:], body)
+
+	_, err = c.conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer c.conn.SetReadDeadline(time.Time{}) // Disable the deadline
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Drop stray packets, e.g. late answers to a previous transmission
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != txID {
+			continue
+		}
+
+		respAction := binary.BigEndian.Uint32(buf[0:4])
+		if respAction == actionError {
+			return nil, &TrackerError{Tracker: c.host, Reason: string(buf[8:n])}
+		}
+		if respAction != action {
+			return nil, fmt.Errorf("expected action %d from tracker %s but got %d", action, c.host, respAction)
+		}
+		return buf[:n], nil
+	}
+}
+
+// returns a connection ID for the tracker, reusing the cached one while it is still valid.
+// cached tells if it was reused
+func (c *udpClient) connectionID(timeout time.Duration) (id uint64, cached bool, err error) {
+	udpConnectionIDs.Lock()
+	known, ok := udpConnectionIDs.ids[c.host]
+	udpConnectionIDs.Unlock()
+	if ok && time.Since(known.obtained) < UDPConnectionIDLifetime {
+		return known.id, true, nil
+	}
+
+	resp, err := c.exchange(udpProtocolID, actionConnect, nil, timeout)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(resp) < 16 {
+		return 0, false, fmt.Errorf("connect response too short. %d < 16", len(resp))
+	}
+	id = binary.BigEndian.Uint64(resp[8:16])
+
+	udpConnectionIDs.Lock()
+	udpConnectionIDs.ids[c.host] = udpConnectionID{id: id, obtained: time.Now()}
+	udpConnectionIDs.Unlock()
+	return id, false, nil
+}
+
+// forgets a connection ID the tracker refused, unless another request replaced it already
+func (c *udpClient) forgetConnectionID(id uint64) {
+	udpConnectionIDs.Lock()
+	defer udpConnectionIDs.Unlock()
+	if udpConnectionIDs.ids[c.host].id == id {
+		delete(udpConnectionIDs.ids, c.host)
+	}
+}
+
+// sends a request, connecting first when needed, and retransmits with exponential backoff.
+// The full schedule takes more than two hours, ctx puts an end to it
+func (c *udpClient) request(ctx context.Context, action uint32, body []byte) ([]byte, error) {
+	// Closing the connection interrupts the exchange waiting for an answer
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.Close()
+		case <-stop:
+		}
+	}()
+
+	outOfTime := false
+	reconnected := false
+	for n := 0; n <= UDPMaxRetries && !outOfTime; n++ {
+		timeout := UDPTimeout << uint(n)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= timeout {
+			// No time left for another retransmission
+			timeout = time.Until(deadline)
+			outOfTime = true
+		}
+
+		connID, cached, err := c.connectionID(timeout)
+		if ctx.Err() != nil {
+			break
+		}
+		if isTimeout(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.exchange(connID, action, body, timeout)
+		if ctx.Err() != nil {
+			break
+		}
+		if isTimeout(err) {
+			continue
+		}
+		var trackerErr *TrackerError
+		if errors.As(err, &trackerErr) && cached && !reconnected {
+			// The tracker may forget connection IDs sooner than we do, e.g. after a restart.
+			// Connect again once, without counting it as a retransmission
+			c.forgetConnectionID(connID)
+			reconnected = true
+			outOfTime = false
+			n--
+			continue
+		}
+		return resp, err
+	}
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("tracker %s did not respond: %w", c.host, ctx.Err())
+	}
+	if outOfTime {
+		return nil, fmt.Errorf("tracker %s did not respond: %w", c.host, context.DeadlineExceeded)
+	}
+	return nil, fmt.Errorf("tracker %s did not respond after %d retransmissions", c.host, UDPMaxRetries)
+}
+
+// event codes of UDP announces
+var udpEvents = map[string]uint32{
+	EventNone:      0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+func (c *udpClient) announce(ctx context.Context, infoHash [20]byte, req AnnounceRequest) (*TrackerResponse, error) {
+	body := make([]byte, 82)
+	copy(body[0:20], infoHash[:])
+	copy(body[20:40], req.PeerID[:])
+	binary.BigEndian.PutUint64(body[40:48], uint64(req.Downloaded))
+	binary.BigEndian.PutUint64(body[48:56], uint64(req.Left))
+	binary.BigEndian.PutUint64(body[56:64], uint64(req.Uploaded))
+	binary.BigEndian.PutUint32(body[64:68], udpEvents[req.Event])
+	binary.BigEndian.PutUint32(body[68:72], 0)          // ip: use the sender's address
+	binary.BigEndian.PutUint32(body[72:76], udpKey)     // key
+	binary.BigEndian.PutUint32(body[76:80], 0xFFFFFFFF) // num_want: default
+	binary.BigEndian.PutUint16(body[80:82], req.Port)
+
+	resp, err := c.request(ctx, actionAnnounce, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 20 {
+		return nil, fmt.Errorf("announce response too short. %d < 20", len(resp))
+	}
+	// Trackers reached over IPv6 answer with IPv6 peers
+	unmarshal := peers.Unmarshal
+	if addr, ok := c.conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		unmarshal = peers.Unmarshal6
+	}
+	found, err := unmarshal(resp[20:])
+	if err != nil {
+		return nil, err
+	}
+	return &TrackerResponse{
+		Interval:   int(binary.BigEndian.Uint32(resp[8:12])),
+		Incomplete: int(binary.BigEndian.Uint32(resp[12:16])),
+		Complete:   int(binary.BigEndian.Uint32(resp[16:20])),
+		Peers:      found,
+	}, nil
+}
+
+func (c *udpClient) scrape(ctx context.Context, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	if len(infoHashes) > MaxScrapeHashes {
+		return nil, fmt.Errorf("cannot scrape more than %d info-hashes at once", MaxScrapeHashes)
+	}
+	body := make([]byte, 0, 20*len(infoHashes))
+	for _, infoHash := range infoHashes {
+		body = append(body, infoHash[:]...)
+	}
+
+	resp, err := c.request(ctx, actionScrape, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 8+12*len(infoHashes) {
+		return nil, fmt.Errorf("scrape response too short for %d info-hashes", len(infoHashes))
+	}
+
+	results := make([]ScrapeResult, len(infoHashes))
+	for i := range results {
+		offset := 8 + 12*i
+		results[i] = ScrapeResult{
+			Complete:   int(binary.BigEndian.Uint32(resp[offset : offset+4])),
+			Downloaded: int(binary.BigEndian.Uint32(resp[offset+4 : offset+8])),
+			Incomplete: int(binary.BigEndian.Uint32(resp[offset+8 : offset+12])),
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,187 @@
+package torrentfile
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeUDPTracker answers BEP 15 requests on loopback. It hands out a single peer and
+// remembers the last announce it received
+type fakeUDPTracker struct {
+	conn     net.PacketConn
+	connID   uint64
+	announce chan []byte
+	connects int32  // number of connect requests
+	reject   string // when set, announces and scrapes get this error
+}
+
+func newFakeUDPTracker(t *testing.T, reject string) *fakeUDPTracker {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &fakeUDPTracker{conn: conn, connID: 0x1122334455667788, announce: make(chan []byte, 1), reject: reject}
+	t.Cleanup(func() { conn.Close() })
+	go tr.serve()
+	return tr
+}
+
+func (tr *fakeUDPTracker) url() string {
+	return "udp://" + tr.conn.LocalAddr().String()
+}
+
+func (tr *fakeUDPTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := tr.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < 16 {
+			continue
+		}
+		connID := binary.BigEndian.Uint64(buf[0:8])
+		action := binary.BigEndian.Uint32(buf[8:12])
+		txID := binary.BigEndian.Uint32(buf[12:16])
+
+		resp := make([]byte, 8)
+		binary.BigEndian.PutUint32(resp[0:4], action)
+		binary.BigEndian.PutUint32(resp[4:8], txID)
+		switch {
+		case action == actionConnect && connID == udpProtocolID:
+			atomic.AddInt32(&tr.connects, 1)
+			resp = binary.BigEndian.AppendUint64(resp, tr.connID)
+		case connID != tr.connID:
+			binary.BigEndian.PutUint32(resp[0:4], actionError)
+			resp = append(resp, "unknown connection id"...)
+		case tr.reject != "":
+			binary.BigEndian.PutUint32(resp[0:4], actionError)
+			resp = append(resp, tr.reject...)
+		case action == actionAnnounce:
+			select {
+			case tr.announce <- append([]byte{}, buf[16:n]...):
+			default:
+			}
+			resp = binary.BigEndian.AppendUint32(resp, 1800) // interval
+			resp = binary.BigEndian.AppendUint32(resp, 3)    // leechers
+			resp = binary.BigEndian.AppendUint32(resp, 5)    // seeders
+			resp = append(resp, 10, 0, 0, 1, 0x1a, 0xe1)     // 10.0.0.1:6881
+		case action == actionScrape:
+			for i := 16; i+20 <= n; i += 20 {
+				resp = binary.BigEndian.AppendUint32(resp, 5) // seeders
+				resp = binary.BigEndian.AppendUint32(resp, 7) // completed
+				resp = binary.BigEndian.AppendUint32(resp, 3) // leechers
+			}
+		default:
+			continue
+		}
+		tr.conn.WriteTo(resp, addr)
+	}
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	tr := newFakeUDPTracker(t, "")
+	torrent := Torrent{AnnounceList: [][]string{{tr.url()}}, InfoHash: [20]byte{1, 2, 3}}
+	req := AnnounceRequest{PeerID: [20]byte{4, 5, 6}, Port: 6882, Left: 1000, Event: EventStarted}
+
+	resp, err := torrent.SendAnnounce(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Interval != 1800 || resp.Incomplete != 3 || resp.Complete != 5 {
+		t.Errorf("got interval %d, leechers %d, seeders %d", resp.Interval, resp.Incomplete, resp.Complete)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "10.0.0.1:6881" {
+		t.Errorf("got peers %v", resp.Peers)
+	}
+
+	body := <-tr.announce
+	if !bytes.Equal(body[0:20], torrent.InfoHash[:]) || !bytes.Equal(body[20:40], req.PeerID[:]) {
+		t.Errorf("announce carries info-hash %x and peer ID %x", body[0:20], body[20:40])
+	}
+	if left := binary.BigEndian.Uint64(body[48:56]); left != 1000 {
+		t.Errorf("announce carries left %d", left)
+	}
+	if event := binary.BigEndian.Uint32(body[64:68]); event != udpEvents[EventStarted] {
+		t.Errorf("announce carries event %d", event)
+	}
+	if port := binary.BigEndian.Uint16(body[80:82]); port != 6882 {
+		t.Errorf("announce carries port %d", port)
+	}
+}
+
+func TestUDPScrape(t *testing.T) {
+	tr := newFakeUDPTracker(t, "")
+	first, second := [20]byte{1}, [20]byte{2}
+
+	results, err := Scrape(context.Background(), tr.url(), first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ScrapeResult{Complete: 5, Downloaded: 7, Incomplete: 3}
+	for _, infoHash := range [][20]byte{first, second} {
+		if results[infoHash] != want {
+			t.Errorf("%x: got %+v, want %+v", infoHash, results[infoHash], want)
+		}
+	}
+}
+
+func TestUDPStaleConnectionID(t *testing.T) {
+	tr := newFakeUDPTracker(t, "")
+	host := tr.conn.LocalAddr().String()
+	udpConnectionIDs.Lock()
+	udpConnectionIDs.ids[host] = udpConnectionID{id: 42, obtained: time.Now()}
+	udpConnectionIDs.Unlock()
+
+	_, err := Scrape(context.Background(), tr.url(), [20]byte{1})
+	if err != nil {
+		t.Fatalf("got %v, want a retry with a fresh connection ID", err)
+	}
+	if connects := atomic.LoadInt32(&tr.connects); connects != 1 {
+		t.Errorf("connected %d times, want 1", connects)
+	}
+	udpConnectionIDs.Lock()
+	cached := udpConnectionIDs.ids[host]
+	udpConnectionIDs.Unlock()
+	if cached.id != tr.connID {
+		t.Errorf("cached connection ID %d, want %d", cached.id, tr.connID)
+	}
+}
+
+func TestUDPTrackerError(t *testing.T) {
+	tr := newFakeUDPTracker(t, "torrent not registered")
+
+	_, err := Scrape(context.Background(), tr.url(), [20]byte{1})
+	var trackerErr *TrackerError
+	if !errors.As(err, &trackerErr) || trackerErr.Reason != "torrent not registered" {
+		t.Errorf("got %v, want the tracker's error", err)
+	}
+	if connects := atomic.LoadInt32(&tr.connects); connects != 1 {
+		t.Errorf("connected %d times, want 1", connects)
+	}
+}
+
+func TestUDPSilentTracker(t *testing.T) {
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = Scrape(ctx, "udp://"+silent.LocalAddr().String(), [20]byte{1})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the deadline to be exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("gave up after %s", elapsed)
+	}
+}
@@ -0,0 +1,78 @@
+package tracker
+
+import (
+	"math/rand"
+	"net"
+	"time"
+
+	"torrent/peers"
+)
+
+// peerEntry is what the tracker remembers about a peer of a swarm
+type peerEntry struct {
+	id       string
+	ip       net.IP // IPv4 address, nil if unknown
+	ip6      net.IP // IPv6 address, nil if unknown
+	port     uint16
+	left     int64
+	lastSeen time.Time
+}
+
+func (p *peerEntry) addrs() []peers.Peer {
+	found := []peers.Peer{}
+	if p.ip != nil {
+		found = append(found, peers.Peer{IP: p.ip, Port: p.port})
+	}
+	if p.ip6 != nil {
+		found = append(found, peers.Peer{IP: p.ip6, Port: p.port})
+	}
+	return found
+}
+
+// swarm holds the peers of one info-hash, keyed by peer ID
+type swarm struct {
+	peers      map[string]*peerEntry
+	downloaded int
+}
+
+func newSwarm() *swarm {
+	return &swarm{peers: map[string]*peerEntry{}}
+}
+
+// expire forgets the peers that did not announce within timeout
+func (s *swarm) expire(timeout time.Duration) {
+	for id, p := range s.peers {
+		if time.Since(p.lastSeen) > timeout {
+			delete(s.peers, id)
+		}
+	}
+}
+
+// stats returns the number of seeders and leechers
+func (s *swarm) stats() (complete, incomplete int) {
+	for _, p := range s.peers {
+		if p.left == 0 {
+			complete++
+		} else {
+			incomplete++
+		}
+	}
+	return complete, incomplete
+}
+
+// pick returns up to numWant random peers other than the one with ID exclude. Seeders
+// are left out when the requester is a seeder itself
+func (s *swarm) pick(exclude string, numWant int, seeding bool) []*peerEntry {
+	picked := make([]*peerEntry, 0, len(s.peers))
+	for id, p := range s.peers {
+		if id == exclude || (seeding && p.left == 0) {
+			continue
+		}
+		picked = append(picked, p)
+	}
+	rand.Shuffle(len(picked), func(i, j int) { picked[i], picked[j] = picked[j], picked[i] })
+	if len(picked) > numWant {
+		picked = picked[:numWant]
+	}
+	return picked
+}
@@ -0,0 +1,291 @@
+package tracker
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"torrent/peers"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// DefaultInterval is the announce interval handed out to peers
+var DefaultInterval = 30 * time.Minute
+
+// DefaultNumWant is the number of peers returned when the peer does not ask for a number
+const DefaultNumWant = 50
+
+// MaxNumWant is the largest number of peers returned by one announce
+const MaxNumWant = 200
+
+// Tracker is an HTTP BitTorrent tracker serving /announce and /scrape
+type Tracker struct {
+	// Interval is how often peers should announce. Peers that stay silent for twice as
+	// long are dropped from their swarm
+	Interval time.Duration
+	// MinInterval is the shortest interval peers may announce at, 0 to leave it out
+	MinInterval time.Duration
+
+	mu        sync.Mutex
+	swarms    map[[20]byte]*swarm
+	allowlist map[[20]byte]bool
+}
+
+// New creates a tracker accepting any info-hash
+func New() *Tracker {
+	return &Tracker{
+		Interval: DefaultInterval,
+		swarms:   map[[20]byte]*swarm{},
+	}
+}
+
+// Allow restricts the tracker to the given info-hashes, it can be called several times
+func (t *Tracker) Allow(infoHashes ...[20]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.allowlist == nil {
+		t.allowlist = map[[20]byte]bool{}
+	}
+	for _, infoHash := range infoHashes {
+		t.allowlist[infoHash] = true
+	}
+}
+
+func (t *Tracker) allowed(infoHash [20]byte) bool {
+	return t.allowlist == nil || t.allowlist[infoHash]
+}
+
+// ServeHTTP answers announce and scrape requests
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var resp map[string]interface{}
+	var err error
+	switch r.URL.Path {
+	case "/announce":
+		resp, err = t.announce(r)
+	case "/scrape":
+		resp, err = t.scrape(r)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		// Failures are reported in the body, clients expect a 200
+		resp = map[string]interface{}{"failure reason": err.Error()}
+	}
+
+	var buf bytes.Buffer
+	err = bencode.Marshal(&buf, resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(buf.Bytes())
+}
+
+// ListenAndServe runs the tracker on addr, e.g. ":8000"
+func (t *Tracker) ListenAndServe(addr string) error {
+	log.Printf("Tracker listening on %s\n", addr)
+	return http.ListenAndServe(addr, t)
+}
+
+// returns the swarm of an info-hash without its expired peers, creating it if needed
+func (t *Tracker) swarm(infoHash [20]byte) *swarm {
+	s, ok := t.swarms[infoHash]
+	if !ok {
+		s = newSwarm()
+		t.swarms[infoHash] = s
+	}
+	s.expire(2 * t.Interval)
+	return s
+}
+
+func infoHashParam(value string) ([20]byte, error) {
+	var infoHash [20]byte
+	if len(value) != 20 {
+		return infoHash, fmt.Errorf("invalid info_hash")
+	}
+	copy(infoHash[:], value)
+	return infoHash, nil
+}
+
+func intParam(r *http.Request, key string, required bool) (int64, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" && !required {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s", key)
+	}
+	return n, nil
+}
+
+// returns the address the request came from
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// parses an address parameter (ip or ipv6). They are only honored for requests from the
+// local network: anyone else could register the address of a third party, which would then
+// be flooded with connections by the swarm
+func addrParam(r *http.Request, key string) net.IP {
+	from := remoteIP(r)
+	if from == nil || !from.IsLoopback() && !from.IsPrivate() {
+		return nil
+	}
+	return net.ParseIP(r.URL.Query().Get(key))
+}
+
+func (t *Tracker) announce(r *http.Request) (map[string]interface{}, error) {
+	params := r.URL.Query()
+	infoHash, err := infoHashParam(params.Get("info_hash"))
+	if err != nil {
+		return nil, err
+	}
+	peerID := params.Get("peer_id")
+	if len(peerID) != 20 {
+		return nil, fmt.Errorf("invalid peer_id")
+	}
+	port, err := intParam(r, "port", true)
+	if err != nil || port == 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port")
+	}
+	left, err := intParam(r, "left", true)
+	if err != nil {
+		return nil, err
+	}
+	numWant, err := intParam(r, "numwant", false)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := params["numwant"]; !ok {
+		numWant = DefaultNumWant
+	}
+	if numWant > MaxNumWant {
+		numWant = MaxNumWant
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.allowed(infoHash) {
+		return nil, fmt.Errorf("unregistered torrent")
+	}
+	s := t.swarm(infoHash)
+
+	event := params.Get("event")
+	if event == "stopped" {
+		delete(s.peers, peerID)
+	} else {
+		entry, ok := s.peers[peerID]
+		if !ok {
+			entry = &peerEntry{id: peerID}
+			s.peers[peerID] = entry
+		}
+		entry.port = uint16(port)
+		entry.left = left
+		entry.lastSeen = time.Now()
+		ip := addrParam(r, "ip")
+		if ip == nil {
+			ip = remoteIP(r)
+		}
+		if ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				entry.ip = ip4
+			} else {
+				entry.ip6 = ip
+			}
+		}
+		if ip6 := addrParam(r, "ipv6"); ip6 != nil && ip6.To4() == nil {
+			entry.ip6 = ip6
+		}
+		if event == "completed" {
+			s.downloaded++
+		}
+	}
+
+	complete, incomplete := s.stats()
+	resp := map[string]interface{}{
+		"interval":   int(t.Interval.Seconds()),
+		"complete":   complete,
+		"incomplete": incomplete,
+	}
+	if t.MinInterval > 0 {
+		resp["min interval"] = int(t.MinInterval.Seconds())
+	}
+
+	picked := s.pick(peerID, int(numWant), left == 0)
+	if params.Get("compact") == "1" {
+		found := []peers.Peer{}
+		for _, p := range picked {
+			found = append(found, p.addrs()...)
+		}
+		resp["peers"] = string(peers.Marshal(found))
+		if peers6 := peers.Marshal6(found); len(peers6) > 0 {
+			resp["peers6"] = string(peers6)
+		}
+	} else {
+		noPeerID := params.Get("no_peer_id") == "1"
+		list := []interface{}{}
+		for _, p := range picked {
+			for _, addr := range p.addrs() {
+				dict := map[string]interface{}{"ip": addr.IP.String(), "port": int(addr.Port)}
+				if !noPeerID {
+					dict["peer id"] = p.id
+				}
+				list = append(list, dict)
+			}
+		}
+		resp["peers"] = list
+	}
+	return resp, nil
+}
+
+func (t *Tracker) scrape(r *http.Request) (map[string]interface{}, error) {
+	infoHashes := [][20]byte{}
+	for _, value := range r.URL.Query()["info_hash"] {
+		infoHash, err := infoHashParam(value)
+		if err != nil {
+			return nil, err
+		}
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(infoHashes) == 0 {
+		// No info-hash means every swarm we know about
+		for infoHash := range t.swarms {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+
+	files := map[string]interface{}{}
+	for _, infoHash := range infoHashes {
+		if !t.allowed(infoHash) {
+			continue
+		}
+		complete, incomplete, downloaded := 0, 0, 0
+		if s, ok := t.swarms[infoHash]; ok {
+			s.expire(2 * t.Interval)
+			complete, incomplete = s.stats()
+			downloaded = s.downloaded
+		}
+		files[string(infoHash[:])] = map[string]interface{}{
+			"complete":   complete,
+			"downloaded": downloaded,
+			"incomplete": incomplete,
+		}
+	}
+	return map[string]interface{}{"files": files}, nil
+}
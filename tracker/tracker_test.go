@@ -0,0 +1,149 @@
+package tracker_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"torrent/peers"
+	"torrent/torrentfile"
+	"torrent/tracker"
+
+	"github.com/jackpal/bencode-go"
+)
+
+var infoHash = [20]byte{0xca, 0xfe}
+
+// starts a tracker and returns its announce URL
+func serve(t *testing.T, tr *tracker.Tracker) string {
+	srv := httptest.NewServer(tr)
+	t.Cleanup(srv.Close)
+	return srv.URL + "/announce"
+}
+
+func announce(t *testing.T, url string, peerID byte, port uint16, left int, event string) *torrentfile.AnnounceResponse {
+	torrent := torrentfile.Torrent{AnnounceList: [][]string{{url}}, InfoHash: infoHash}
+	resp, err := torrent.SendAnnounce(context.Background(), torrentfile.AnnounceRequest{
+		PeerID: [20]byte{peerID},
+		Port:   port,
+		Left:   left,
+		Event:  event,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestAnnounce(t *testing.T) {
+	url := serve(t, tracker.New())
+
+	first := announce(t, url, 1, 6881, 0, torrentfile.EventStarted)
+	if len(first.Peers) != 0 {
+		t.Errorf("first peer got peers %v", first.Peers)
+	}
+	if first.Interval != int(tracker.DefaultInterval.Seconds()) {
+		t.Errorf("got interval %d", first.Interval)
+	}
+
+	leech := announce(t, url, 2, 6882, 100, torrentfile.EventStarted)
+	if len(leech.Peers) != 1 || leech.Peers[0].String() != "127.0.0.1:6881" {
+		t.Errorf("leecher got peers %v, want the seeder", leech.Peers)
+	}
+	if leech.Complete != 1 || leech.Incomplete != 1 {
+		t.Errorf("got %d seeders and %d leechers", leech.Complete, leech.Incomplete)
+	}
+
+	// Seeders have nothing to get from each other
+	seed := announce(t, url, 3, 6883, 0, torrentfile.EventStarted)
+	if len(seed.Peers) != 1 || seed.Peers[0].String() != "127.0.0.1:6882" {
+		t.Errorf("seeder got peers %v, want the leecher only", seed.Peers)
+	}
+}
+
+func TestScrape(t *testing.T) {
+	url := serve(t, tracker.New())
+	announce(t, url, 1, 6881, 0, torrentfile.EventStarted)
+	announce(t, url, 2, 6882, 100, torrentfile.EventStarted)
+	announce(t, url, 3, 6883, 100, torrentfile.EventStarted)
+	announce(t, url, 2, 6882, 0, torrentfile.EventCompleted)
+	announce(t, url, 3, 6883, 100, torrentfile.EventStopped)
+
+	results, err := torrentfile.Scrape(context.Background(), url, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := torrentfile.ScrapeResult{Complete: 2, Downloaded: 1, Incomplete: 0}
+	if results[infoHash] != want {
+		t.Errorf("got %+v, want %+v", results[infoHash], want)
+	}
+}
+
+func TestAllow(t *testing.T) {
+	tr := tracker.New()
+	tr.Allow([20]byte{1})
+	url := serve(t, tr)
+
+	torrent := torrentfile.Torrent{AnnounceList: [][]string{{url}}, InfoHash: infoHash}
+	_, err := torrent.SendAnnounce(context.Background(), torrentfile.AnnounceRequest{PeerID: [20]byte{1}, Port: 6881})
+	var trackerErr *torrentfile.TrackerError
+	if !errors.As(err, &trackerErr) {
+		t.Errorf("got %v, want the tracker to refuse the torrent", err)
+	}
+
+	results, err := torrentfile.Scrape(context.Background(), url, infoHash, [20]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := results[infoHash]; ok || len(results) != 1 {
+		t.Errorf("scrape reported %v, want the allowed torrent only", results)
+	}
+}
+
+// announces from the address from with the given ip parameter and returns the peers
+func announceFrom(t *testing.T, tr *tracker.Tracker, from string, peerID byte, ip string) []peers.Peer {
+	params := url.Values{
+		"info_hash": {string(infoHash[:])},
+		"peer_id":   {string([]byte{peerID, 19: 0})},
+		"port":      {"6881"},
+		"left":      {"100"},
+		"compact":   {"1"},
+		"ip":        {ip},
+	}
+	r := httptest.NewRequest("GET", "/announce?"+params.Encode(), nil)
+	r.RemoteAddr = from
+	w := httptest.NewRecorder()
+	tr.ServeHTTP(w, r)
+
+	resp := struct {
+		Peers string `bencode:"peers"`
+	}{}
+	if err := bencode.Unmarshal(w.Body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	found, err := peers.Unmarshal([]byte(resp.Peers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestIPParameter(t *testing.T) {
+	tr := tracker.New()
+
+	// A client on the internet cannot register someone else's address
+	announceFrom(t, tr, "203.0.113.5:40000", 1, "198.51.100.7")
+	// A client on the local network can, e.g. to give its address on the LAN
+	announceFrom(t, tr, "192.168.1.10:40000", 2, "192.168.1.20")
+
+	found := announceFrom(t, tr, "203.0.113.9:40000", 3, "")
+	got := map[string]bool{}
+	for _, peer := range found {
+		got[peer.String()] = true
+	}
+	if len(found) != 2 || !got["203.0.113.5:6881"] || !got["192.168.1.20:6881"] {
+		t.Errorf("got peers %v, want 203.0.113.5:6881 and 192.168.1.20:6881", found)
+	}
+}